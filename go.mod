@@ -1,3 +1,10 @@
 module github.com/zbrumen/remote-serve
 
 go 1.20
+
+require (
+	github.com/gorilla/websocket v1.5.1
+	golang.org/x/net v0.17.0
+)
+
+require golang.org/x/text v0.13.0 // indirect
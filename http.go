@@ -1,59 +1,48 @@
 package remote_serve
 
 import (
-	"encoding/base64"
-	"github.com/zbrumen/remote-serve/net"
+	"context"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 	"net/http"
-	"net/url"
-	"strings"
 )
 
-func ListenAndServe(addr string, handler http.Handler) error {
-	srvr := &http.Server{Addr: addr, Handler: handler}
-	if strings.Contains(addr, "remote://") {
-		u, err := url.Parse(addr)
-		if err != nil {
-			return err
-		}
-		secret, _ := u.User.Password()
-		port := ":8080"
-		if u.Path != "/" {
-			temp, err := base64.URLEncoding.DecodeString(u.Path[1:])
-			if err != nil {
-				return err
-			}
-			port = string(temp)
-		}
-		client, err := net.NewClient("tcp", u.Host, u.User.Username(), secret, port)
-		if err != nil {
-			return err
+func newHTTPServer(addr string, handler http.Handler, o *options) *http.Server {
+	if o.h2c {
+		if handler == nil {
+			handler = http.DefaultServeMux
 		}
-		return srvr.Serve(client)
+		handler = h2c.NewHandler(handler, &http2.Server{})
+	}
+	return &http.Server{Addr: addr, Handler: handler}
+}
+
+func ListenAndServe(addr string, handler http.Handler, opts ...Option) error {
+	if addr == "" {
+		addr = ":http"
 	}
-	return srvr.ListenAndServe()
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	srvr := newHTTPServer(addr, handler, &o)
+	listener, err := Listen(context.Background(), addr, opts...)
+	if err != nil {
+		return err
+	}
+	return srvr.Serve(listener)
 }
 
-func ListenAndServeTLS(addr string, handler http.Handler, certFile, keyFile string) error {
+// ListenAndServeTLS negotiates h2 and http/1.1 with ALPN, also on remote://
+// listeners where TLS is terminated on the client end of the tunnel.
+func ListenAndServeTLS(addr string, handler http.Handler, certFile, keyFile string, opts ...Option) error {
+	if addr == "" {
+		addr = ":https"
+	}
 	srvr := &http.Server{Addr: addr, Handler: handler}
-	if strings.Contains(addr, "remote://") {
-		u, err := url.Parse(addr)
-		if err != nil {
-			return err
-		}
-		secret, _ := u.User.Password()
-		port := ":8080"
-		if u.Path != "/" {
-			temp, err := base64.URLEncoding.DecodeString(u.Path[1:])
-			if err != nil {
-				return err
-			}
-			port = string(temp)
-		}
-		client, err := net.NewClient("tcp", u.Host, u.User.Username(), secret, port)
-		if err != nil {
-			return err
-		}
-		return srvr.ServeTLS(client, certFile, keyFile)
+	listener, err := Listen(context.Background(), addr, opts...)
+	if err != nil {
+		return err
 	}
-	return srvr.ListenAndServeTLS(certFile, keyFile)
+	return srvr.ServeTLS(listener, certFile, keyFile)
 }
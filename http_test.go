@@ -2,17 +2,29 @@ package remote_serve
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/base64"
+	"encoding/pem"
 	"fmt"
 	"github.com/zbrumen/remote-serve/net"
+	"golang.org/x/net/http2"
 	"io"
+	"math/big"
+	gonet "net"
 	"net/http"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
 
 func TestListenAndServe(t *testing.T) {
-	_, err := net.NewServer(":4000", map[string]string{
+	_, err := net.NewServer(":4000", net.StaticAuthenticator{
 		"username": "password",
 	})
 	if err != nil {
@@ -24,7 +36,7 @@ func TestListenAndServe(t *testing.T) {
 				fmt.Println("Method:", r.Method)
 				rw.Write([]byte("Secret"))
 			})); err != nil {
-				t.Fatal(err)
+				t.Error(err)
 			}
 		}()
 		// wait for everything to setup
@@ -33,7 +45,8 @@ func TestListenAndServe(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
-		ctx, _ := context.WithTimeout(context.Background(), time.Second*3)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+		defer cancel()
 		req = req.WithContext(ctx)
 		resp, err := http.DefaultClient.Do(req)
 		if err != nil {
@@ -53,3 +66,125 @@ func TestListenAndServe(t *testing.T) {
 		}
 	}
 }
+
+func writeTestCertificate(t *testing.T) (certFile, keyFile string, pool *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []gonet.IP{gonet.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawKey, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: rawKey}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool = x509.NewCertPool()
+	pool.AddCert(cert)
+	return certFile, keyFile, pool
+}
+
+func protoHandler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		_, _ = rw.Write([]byte(r.Proto))
+	})
+}
+
+func getProto(t *testing.T, client *http.Client, url string) string {
+	t.Helper()
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	out, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+func TestListenAndServeTLSNegotiatesHTTP2(t *testing.T) {
+	srvr, err := net.NewServer("127.0.0.1:0", net.StaticAuthenticator{"username": "password"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile, pool := writeTestCertificate(t)
+	bind := freeAddr(t)
+	served := make(chan error, 1)
+	go func() {
+		served <- ListenAndServeTLS("remote://username:password@"+srvr.Addr().String()+"/"+bind, protoHandler(), certFile, keyFile)
+	}()
+	waitForAddr(t, bind)
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: pool},
+		ForceAttemptHTTP2: true,
+	}}
+	if proto := getProto(t, client, "https://"+bind); proto != "HTTP/2.0" {
+		t.Fatal("expected h2 through the tunnel, got " + proto)
+	}
+	client.CloseIdleConnections()
+	_ = srvr.Close()
+	select {
+	case <-served:
+	case <-time.After(time.Second * 5):
+		t.Fatal("ListenAndServeTLS did not return after the server closed")
+	}
+}
+
+func TestServeH2C(t *testing.T) {
+	srvr, err := net.NewServer("127.0.0.1:0", net.StaticAuthenticator{"username": "password"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srvr.Close()
+	bind := freeAddr(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	served := make(chan error, 1)
+	go func() {
+		served <- Serve(ctx, "remote://username:password@"+srvr.Addr().String()+"/"+bind, protoHandler(), WithH2C())
+	}()
+	waitForAddr(t, bind)
+	h2c := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (gonet.Conn, error) {
+			var dialer gonet.Dialer
+			return dialer.DialContext(ctx, network, addr)
+		},
+	}}
+	if proto := getProto(t, h2c, "http://"+bind); proto != "HTTP/2.0" {
+		t.Fatal("expected h2c through the tunnel, got " + proto)
+	}
+	if proto := getProto(t, http.DefaultClient, "http://"+bind); proto != "HTTP/1.1" {
+		t.Fatal("expected HTTP/1.1 next to h2c, got " + proto)
+	}
+	h2c.CloseIdleConnections()
+	cancel()
+	if err = <-served; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,100 @@
+package remote_serve
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/zbrumen/remote-serve/net"
+	gonet "net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type options struct {
+	client          []net.ClientOption
+	tls             *tls.Config
+	shutdownTimeout time.Duration
+	h2c             bool
+}
+
+type Option func(*options)
+
+// WithClientOptions are passed to net.NewClient for remote:// URLs.
+func WithClientOptions(opts ...net.ClientOption) Option {
+	return func(o *options) {
+		o.client = append(o.client, opts...)
+	}
+}
+
+// WithTLSConfig is used to connect to the server of remote+tls:// and
+// remote+wss:// URLs.
+func WithTLSConfig(config *tls.Config) Option {
+	return func(o *options) {
+		o.tls = config
+	}
+}
+
+// WithShutdownTimeout bounds how long Serve waits for in-flight requests
+// once its context is done.
+func WithShutdownTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.shutdownTimeout = timeout
+	}
+}
+
+// WithH2C serves HTTP/2 without TLS next to HTTP/1, so gRPC and other
+// prior knowledge HTTP/2 clients can reach plaintext listeners.
+func WithH2C() Option {
+	return func(o *options) {
+		o.h2c = true
+	}
+}
+
+func listenRemote(ctx context.Context, u *url.URL, opts *options) (gonet.Listener, error) {
+	remote, err := parseRemoteURL(u)
+	if err != nil {
+		return nil, err
+	}
+	clientOptions := remote.clientOptions(opts)
+	dial := func(ctx context.Context) (*net.Client, error) {
+		return net.NewClientContext(ctx, "tcp", remote.server, remote.key, remote.secret, remote.bind, clientOptions...)
+	}
+	if remote.reconnect > 0 {
+		return newReconnectListener(ctx, remote.reconnect, dial)
+	}
+	return dial(ctx)
+}
+
+// Listen returns a listener for tcp://host:port, unix:///path or remote://
+// URLs, see remoteURL for the remote syntax. Addresses without a scheme are
+// listened on with tcp. ctx only bounds setting up the listener.
+func Listen(ctx context.Context, rawURL string, opts ...Option) (gonet.Listener, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if !strings.Contains(rawURL, "://") {
+		var lc gonet.ListenConfig
+		return lc.Listen(ctx, "tcp", rawURL)
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	var lc gonet.ListenConfig
+	switch u.Scheme {
+	case "tcp", "tcp4", "tcp6":
+		return lc.Listen(ctx, u.Scheme, u.Host)
+	case "unix":
+		path := u.Host + u.Path
+		if path == "" {
+			path = u.Opaque
+		}
+		return lc.Listen(ctx, "unix", path)
+	case "remote", "remote+tcp", "remote+tls", "remote+ws", "remote+wss":
+		return listenRemote(ctx, u, &o)
+	default:
+		return nil, fmt.Errorf("unsupported listen scheme %s", u.Scheme)
+	}
+}
@@ -0,0 +1,75 @@
+package remote_serve
+
+import (
+	"context"
+	"encoding/base64"
+	"github.com/zbrumen/remote-serve/net"
+	gonet "net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testListener(t *testing.T, listener gonet.Listener, dial func() (gonet.Conn, error)) {
+	t.Helper()
+	accepted := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			_, err = conn.Write([]byte("ok"))
+			_ = conn.Close()
+		}
+		accepted <- err
+	}()
+	conn, err := dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	out := make([]byte, 2)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second * 3))
+	if _, err = conn.Read(out); err != nil || string(out) != "ok" {
+		t.Fatal("listener did not serve the connection", err)
+	}
+	if err = <-accepted; err != nil {
+		t.Fatal(err)
+	}
+	_ = listener.Close()
+	if _, err = listener.Accept(); err == nil {
+		t.Fatal("closed listener accepted a connection")
+	}
+}
+
+func TestListen(t *testing.T) {
+	ctx := context.Background()
+	listener, err := Listen(ctx, "tcp://127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testListener(t, listener, func() (gonet.Conn, error) {
+		return gonet.Dial("tcp", listener.Addr().String())
+	})
+
+	path := filepath.Join(t.TempDir(), "remote-serve.sock")
+	listener, err = Listen(ctx, "unix://"+path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testListener(t, listener, func() (gonet.Conn, error) {
+		return gonet.Dial("unix", path)
+	})
+
+	srvr, err := net.NewServer("127.0.0.1:0", net.StaticAuthenticator{"username": "password"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srvr.Close()
+	listener, err = Listen(ctx, "remote://username:password@"+srvr.Addr().String()+"/"+base64.URLEncoding.EncodeToString([]byte("127.0.0.1:0")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bind := listener.(*net.Client).Tunnel().Bind
+	testListener(t, listener, func() (gonet.Conn, error) {
+		return gonet.Dial("tcp", bind)
+	})
+}
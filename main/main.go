@@ -1,26 +1,198 @@
 package main
 
 import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
 	"flag"
+	"fmt"
 	"github.com/zbrumen/remote-serve/net"
+	"net/http"
+	"os"
 	"strings"
+	"time"
 )
 
+func keygen(args []string) {
+	flags := flag.NewFlagSet("keygen", flag.ExitOnError)
+	out := flags.String("out", "remote-serve.key", "File the private key is written to")
+	_ = flags.Parse(args)
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	if err = os.WriteFile(*out, []byte(net.EncodePrivateKey(private)+"\n"), 0600); err != nil {
+		panic(err)
+	}
+	fmt.Println(net.EncodePublicKey(public))
+}
+
+func loadTokenSecret(path string) []byte {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		panic(err)
+	}
+	secret := bytes.TrimSpace(raw)
+	if len(secret) == 0 {
+		panic("empty token secret")
+	}
+	return secret
+}
+
+func token(args []string) {
+	flags := flag.NewFlagSet("token", flag.ExitOnError)
+	secretFile := flags.String("token-secret-file", "", "Token secret of the server")
+	key := flags.String("key", "", "Key the token authenticates as")
+	binds := flags.String("binds", "", "Comma separated addresses the token may bind, empty allows all")
+	dials := flags.String("dials", "", "Comma separated host:port patterns the token may open forward tunnels to")
+	ttl := flags.Duration("ttl", time.Hour, "How long the token stays valid")
+	_ = flags.Parse(args)
+	if *secretFile == "" {
+		panic("-token-secret-file is required")
+	}
+	claims := net.TokenClaims{
+		Key:     *key,
+		Expires: time.Now().Add(*ttl).UTC(),
+	}
+	if *binds != "" {
+		claims.Binds = strings.Split(*binds, ",")
+	}
+	if *dials != "" {
+		claims.Dials = strings.Split(*dials, ",")
+	}
+	out, err := net.NewToken(loadTokenSecret(*secretFile), claims)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(out)
+}
+
 func main() {
-	port := flag.String("port", ":4200", "Address where the remote-server listens to")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "keygen":
+			keygen(os.Args[2:])
+			return
+		case "token":
+			token(os.Args[2:])
+			return
+		}
+	}
+	port := flag.String("port", ":4200", "Address where the remote-server listens to, host:port or unix:/path")
 	rawAuths := flag.String("auths", "user:pass;guest:guest", "Authentication library")
+	authsFile := flag.String("auths-file", "", "File with key:secret lines, used instead of -auths")
+	authWebhook := flag.String("auth-webhook", "", "URL authentication attempts are posted to, used instead of -auths")
+	authorizedKeys := flag.String("authorized-keys", "", "File with \"key public-key\" lines for Ed25519 clients")
+	hostKey := flag.String("host-key", "", "Private key the server proves itself to Ed25519 clients with")
+	tokenSecret := flag.String("token-secret-file", "", "Secret tokens minted with the token subcommand are signed with")
+	requireEncryption := flag.Bool("require-encryption", false, "Reject clients that do not encrypt their control connection")
+	tlsCert := flag.String("tls-cert", "", "Certificate to serve the control port and WebSocket endpoint with")
+	tlsKey := flag.String("tls-key", "", "Key of -tls-cert")
+	wsAddr := flag.String("ws-addr", "", "Address where clients can connect with WebSockets")
+	unixBindDir := flag.String("unix-bind-dir", "", "Directory clients may bind unix:/path sockets in")
+	allowSources := flag.String("allow-sources", "", "Comma separated CIDRs public connections must come from")
+	denySources := flag.String("deny-sources", "", "Comma separated CIDRs public connections are refused from")
+	banSources := flag.Bool("ban-sources", false, "Temporarily ban public sources that connect too often or keep failing")
+	adminAddr := flag.String("admin-addr", "", "Address serving the bans at /bans, GET lists and DELETE ?source= lifts them, keep it private")
+	maxStreams := flag.Int("max-streams", 0, "Maximum of concurrent streams per tunnel, 0 for no limit")
 	flag.Parse()
-	auths := make(map[string]string)
-	for _, u := range strings.Split(*rawAuths, ";") {
-		cache := strings.Split(u, ":")
-		if len(cache) != 2 {
-			panic("incorrect auths")
+	var opts []net.ServerOption
+	var tlsConfig *tls.Config
+	if *tlsCert != "" {
+		cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+		if err != nil {
+			panic(err)
 		}
-		auths[cache[0]] = cache[1]
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		opts = append(opts, net.WithTLSConfig(tlsConfig))
+	}
+	if *requireEncryption {
+		opts = append(opts, net.WithRequireEncryption())
+	}
+	if *unixBindDir != "" {
+		opts = append(opts, net.WithUnixBindDir(*unixBindDir))
+	}
+	if *allowSources != "" || *denySources != "" {
+		var policy net.SourcePolicy
+		if *allowSources != "" {
+			policy.Allow = strings.Split(*allowSources, ",")
+		}
+		if *denySources != "" {
+			policy.Deny = strings.Split(*denySources, ",")
+		}
+		opts = append(opts, net.WithSourcePolicy(policy, nil))
+	}
+	if *banSources {
+		opts = append(opts, net.WithSourceLimits(net.DefaultSourceLimits))
+	}
+	if *maxStreams > 0 {
+		opts = append(opts, net.WithMaxStreams(*maxStreams))
+	}
+	if *tokenSecret != "" {
+		opts = append(opts, net.WithTokenSecret(loadTokenSecret(*tokenSecret)))
 	}
-	srvr, err := net.NewServer(*port, auths)
+	if *authorizedKeys != "" {
+		if *hostKey == "" {
+			panic("-authorized-keys needs -host-key")
+		}
+		keys, err := net.LoadAuthorizedKeys(*authorizedKeys)
+		if err != nil {
+			panic(err)
+		}
+		opts = append(opts, net.WithAuthorizedKeys(keys))
+	}
+	if *hostKey != "" {
+		key, err := net.LoadPrivateKey(*hostKey)
+		if err != nil {
+			panic(err)
+		}
+		opts = append(opts, net.WithHostKey(key))
+	}
+	var auth net.Authenticator
+	switch {
+	case *authWebhook != "":
+		auth = net.NewWebhookAuthenticator(*authWebhook, nil)
+	case *authsFile != "":
+		file, err := net.NewFileAuthenticator(*authsFile)
+		if err != nil {
+			panic(err)
+		}
+		auth = file
+	default:
+		auths := make(net.StaticAuthenticator)
+		for _, u := range strings.Split(*rawAuths, ";") {
+			cache := strings.Split(u, ":")
+			if len(cache) != 2 {
+				panic("incorrect auths")
+			}
+			auths[cache[0]] = cache[1]
+		}
+		auth = auths
+	}
+	srvr, err := net.NewServer(*port, auth, opts...)
 	if err != nil {
 		panic(err)
 	}
+	if *wsAddr != "" {
+		ws := &http.Server{Addr: *wsAddr, Handler: srvr.WebSocketHandler(), TLSConfig: tlsConfig}
+		go func() {
+			var err error
+			if tlsConfig != nil {
+				err = ws.ListenAndServeTLS("", "")
+			} else {
+				err = ws.ListenAndServe()
+			}
+			fmt.Println("remote-serve: WEBSOCKET ENDPOINT CLOSED: " + err.Error())
+		}()
+	}
+	if *adminAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/bans", srvr.BansHandler())
+		go func() {
+			err := http.ListenAndServe(*adminAddr, mux)
+			fmt.Println("remote-serve: ADMIN ENDPOINT CLOSED: " + err.Error())
+		}()
+	}
 	<-srvr.Done()
 }
@@ -1,10 +1,12 @@
 package net
 
 import (
+	"crypto/ed25519"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"github.com/zbrumen/remote-serve/protocol"
 	"io"
@@ -18,10 +20,21 @@ func _authWriteMessage(writer io.Writer, msg string) error {
 	return err
 }
 
-func _authReadMessage(reader io.ReadCloser) (string, error) {
+const (
+	maxHelloSize = 4096
+	// the challenge echoes the key of the hello
+	maxChallengeSize = maxHelloSize + 1024
+	maxResponseSize  = 1024
+)
+
+func _authReadMessage(reader io.ReadCloser, max int) (string, error) {
 	var temp []byte
 	cache := make([]byte, 1)
 	for {
+		if len(temp) > base64.StdEncoding.EncodedLen(max) {
+			_ = reader.Close()
+			return "", fmt.Errorf("message exceeds %d bytes", max)
+		}
 		n, err := reader.Read(cache)
 		if err != nil {
 			return "", err
@@ -44,47 +57,315 @@ func _authHashChallenge(challenge, secret string) string {
 	return hex.EncodeToString(h.Sum(nil))
 }
 
-func serverSideAuth(cl net.Conn, auths map[string]string) (protocol.Receiver, protocol.Sender, string, string, error) {
-	hello, err := _authReadMessage(cl)
+func _authDigest(msg string) string {
+	sum := sha256.Sum256([]byte(msg))
+	return hex.EncodeToString(sum[:])
+}
+
+func _authProofMessage(clientNonce, serverNonce, request, response string) string {
+	return fmt.Sprintf("server:%s:%s:%s:%s", clientNonce, serverNonce, _authDigest(request), _authDigest(response))
+}
+
+// _authClientMessage is what the client signs, it binds the answer to the
+// challenge to the client nonce and the exact request so it cannot be
+// replayed with a rewritten request.
+func _authClientMessage(challenge, clientNonce, request string) string {
+	return fmt.Sprintf("client:%s:%s:%s", challenge, clientNonce, _authDigest(request))
+}
+
+func _authSessionMessage(clientNonce, serverNonce, request string) string {
+	return fmt.Sprintf("session:%s:%s:%s", clientNonce, serverNonce, _authDigest(request))
+}
+
+func _authSecureConn(cl net.Conn, sessionKey string, client bool) (net.Conn, error) {
+	key, err := hex.DecodeString(sessionKey)
 	if err != nil {
-		return nil, nil, "", "", err
+		return nil, err
 	}
-	temp := strings.Split(hello, ",")
-	if len(temp) != 2 {
-		return nil, nil, "", "", fmt.Errorf("incorrect hello")
+	return protocol.NewSecureConn(cl, key, client)
+}
+
+func _authSource(addr net.Addr) string {
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return host
 	}
-	key := temp[1]
-	port := temp[0]
-	if secret, ok := auths[key]; ok {
-		challenge := fmt.Sprintf("%s:%s:%s", key, time.Now().String(), protocol.GenerateChars(32))
-		if err = _authWriteMessage(cl, challenge); err != nil {
-			return nil, nil, key, port, err
-		}
-		challengeResp, err := _authReadMessage(cl)
+	return addr.String()
+}
+
+// serverHandshake is an authenticated client that still waits for the
+// response to its tunnel request.
+type serverHandshake struct {
+	conn     net.Conn
+	opts     *serverOptions
+	identity *Identity
+
+	request     protocol.TunnelRequest
+	rawRequest  string
+	serverNonce string
+
+	prove      func(message string) (string, error)
+	sessionKey func(message string) (string, error)
+}
+
+// respond answers the tunnel request. A granted tunnel is passed to register
+// before the client gets the proof, so the server knows the tunnel by the
+// time the client does.
+func (h *serverHandshake) respond(resp protocol.TunnelResponse, register func(tunnel net.Conn) error) error {
+	resp.Version = protocol.Version
+	raw, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	if err = _authWriteMessage(h.conn, string(raw)); err != nil {
+		return err
+	}
+	if resp.Bind == "" {
+		_ = h.conn.Close()
+		return &TunnelError{Code: resp.Error, Message: resp.Message, Fields: resp.Errors}
+	}
+	proof, err := h.prove(_authProofMessage(h.request.Nonce, h.serverNonce, h.rawRequest, string(raw)))
+	if err != nil {
+		return err
+	}
+	cl := h.conn
+	if h.request.Encrypt {
+		session, err := h.sessionKey(_authSessionMessage(h.request.Nonce, h.serverNonce, h.rawRequest))
 		if err != nil {
-			return nil, nil, key, port, err
+			return err
 		}
-		if _authHashChallenge(challenge, secret) == challengeResp {
-			return protocol.NewReceiver(cl), protocol.NewSender(cl), key, port, _authWriteMessage(cl, strings.Join(temp, ","))
-		} else {
-			return nil, nil, key, port, fmt.Errorf("unauthorized")
+		if cl, err = _authSecureConn(cl, session, false); err != nil {
+			return err
 		}
 	}
+	if err = register(cl); err != nil {
+		return err
+	}
+	if err = _authWriteMessage(h.conn, proof); err != nil {
+		return err
+	}
+	return h.conn.SetDeadline(time.Time{})
+}
+
+// _authReject refuses a client before the server proof, the refusal is not
+// signed as it may come before the hello carries a nonce to sign it against.
+func _authReject(cl net.Conn, code, message string) error {
+	raw, err := json.Marshal(protocol.TunnelChallenge{
+		Version: protocol.Version,
+		Error:   code,
+		Message: message,
+	})
+	if err == nil {
+		_ = _authWriteMessage(cl, string(raw))
+	}
 	_ = cl.Close()
-	return nil, nil, key, port, fmt.Errorf("no such key")
+	return &TunnelError{Code: code, Message: message}
 }
 
-func clientSideAuth(cl net.Conn, key, secret, port string) (protocol.Receiver, protocol.Sender, error) {
-	if err := _authWriteMessage(cl, port+","+key); err != nil {
-		return nil, nil, err
+func serverSideAuth(cl net.Conn, auth Authenticator, opts *serverOptions) (*serverHandshake, error) {
+	if opts.handshakeTimeout > 0 {
+		if err := cl.SetDeadline(time.Now().Add(opts.handshakeTimeout)); err != nil {
+			return nil, err
+		}
 	}
-	challenge, err := _authReadMessage(cl)
+	source := _authSource(cl.RemoteAddr())
+	if err := opts.limiter.checkSource(source); err != nil {
+		return nil, _authReject(cl, protocol.ErrorRateLimited, "")
+	}
+	hello, err := _authReadMessage(cl, maxHelloSize)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
+	}
+	out := &serverHandshake{
+		conn:       cl,
+		opts:       opts,
+		rawRequest: hello,
+	}
+	if err = json.Unmarshal([]byte(hello), &out.request); err != nil {
+		opts.limiter.fail(source, "")
+		return nil, _authReject(cl, protocol.ErrorBadRequest, "malformed tunnel request")
+	}
+	if out.request.Version != protocol.Version {
+		return nil, _authReject(cl, protocol.ErrorProtocolVersion, fmt.Sprintf("server speaks version %d", protocol.Version))
+	}
+	key := out.request.Key
+	// a token counts against the key it claims, not against its payload
+	limitKey := key
+	if out.request.Mode == "token" && opts.tokens != nil {
+		if claims, _, err := opts.tokens.claims(key); err == nil {
+			limitKey = claims.Key
+		}
 	}
-	if err = _authWriteMessage(cl, _authHashChallenge(challenge, secret)); err != nil {
-		return nil, nil, err
+	if err = opts.limiter.checkKey(limitKey); err != nil {
+		return nil, _authReject(cl, protocol.ErrorRateLimited, "")
+	}
+	if opts.requireEncryption && !out.request.Encrypt {
+		return nil, _authReject(cl, protocol.ErrorBadRequest, "encryption is required")
+	}
+	switch out.request.Mode {
+	case "hmac", "token":
+		if out.request.Mode == "token" {
+			if opts.tokens == nil {
+				return nil, _authReject(cl, protocol.ErrorBadRequest, "token authentication is not enabled")
+			}
+			auth = opts.tokens
+		}
+		prover, ok := auth.(Prover)
+		if !ok {
+			return nil, _authReject(cl, protocol.ErrorBadRequest, "shared secret authentication is not enabled")
+		}
+		out.prove = func(message string) (string, error) {
+			return prover.Prove(key, message)
+		}
+		out.sessionKey = out.prove
+	case "ed25519":
+		if out.request.Encrypt {
+			return nil, _authReject(cl, protocol.ErrorBadRequest, "encryption needs a shared secret")
+		}
+		if opts.keys == nil {
+			return nil, _authReject(cl, protocol.ErrorBadRequest, "ed25519 authentication is not enabled")
+		}
+		if opts.hostKey == nil {
+			return nil, _authReject(cl, protocol.ErrorBadRequest, "ed25519 authentication needs a server host key")
+		}
+		auth = opts.keys
+		out.prove = func(message string) (string, error) {
+			return base64.StdEncoding.EncodeToString(ed25519.Sign(opts.hostKey, []byte(message))), nil
+		}
+	default:
+		return nil, _authReject(cl, protocol.ErrorBadRequest, "unknown authentication mode "+out.request.Mode)
+	}
+	out.serverNonce = protocol.GenerateChars(32)
+	challenge := fmt.Sprintf("%s:%s:%s", key, time.Now().String(), out.serverNonce)
+	rawChallenge, err := json.Marshal(protocol.TunnelChallenge{
+		Version:   protocol.Version,
+		Challenge: challenge,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err = _authWriteMessage(cl, string(rawChallenge)); err != nil {
+		return nil, err
+	}
+	challengeResp, err := _authReadMessage(cl, maxResponseSize)
+	if err != nil {
+		return nil, err
+	}
+	out.identity, err = auth.Authenticate(key, _authClientMessage(challenge, out.request.Nonce, hello), challengeResp)
+	if err != nil {
+		opts.limiter.fail(source, limitKey)
+		if raw, err := json.Marshal(protocol.TunnelResponse{
+			Version: protocol.Version,
+			Error:   protocol.ErrorUnauthorized,
+		}); err == nil {
+			_ = _authWriteMessage(cl, string(raw))
+		}
+		_ = cl.Close()
+		return nil, err
+	}
+	opts.limiter.succeed(limitKey)
+	return out, nil
+}
+
+func clientSideAuth(cl net.Conn, key, secret, port string, opts *clientOptions) (net.Conn, protocol.TunnelResponse, error) {
+	var resp protocol.TunnelResponse
+	request := protocol.TunnelRequest{
+		Version: protocol.Version,
+		Key:     key,
+		Mode:    "hmac",
+		Nonce:   protocol.GenerateChars(32),
+		Encrypt: opts.encrypt,
+		Bind:    port,
+		Options: opts.tunnel,
+	}
+	if opts.privateKey != nil {
+		if opts.serverKey == nil {
+			return nil, resp, fmt.Errorf("ed25519 authentication requires the server host key")
+		}
+		if opts.encrypt {
+			return nil, resp, fmt.Errorf("encryption needs a shared secret")
+		}
+		request.Mode = "ed25519"
+	} else if opts.token != "" {
+		payload, signature, err := splitToken(opts.token)
+		if err != nil {
+			return nil, resp, err
+		}
+		request.Key, secret = payload, signature
+		request.Mode = "token"
+	}
+	if opts.connectTimeout > 0 {
+		if err := cl.SetDeadline(time.Now().Add(opts.connectTimeout)); err != nil {
+			return nil, resp, err
+		}
+	}
+	rawRequest, err := json.Marshal(request)
+	if err != nil {
+		return nil, resp, err
+	}
+	if err = _authWriteMessage(cl, string(rawRequest)); err != nil {
+		return nil, resp, err
+	}
+	rawChallenge, err := _authReadMessage(cl, maxChallengeSize)
+	if err != nil {
+		return nil, resp, err
+	}
+	var challengeMsg protocol.TunnelChallenge
+	if err = json.Unmarshal([]byte(rawChallenge), &challengeMsg); err != nil {
+		_ = cl.Close()
+		return nil, resp, err
+	}
+	if challengeMsg.Error != "" {
+		_ = cl.Close()
+		return nil, resp, &TunnelError{Code: challengeMsg.Error, Message: challengeMsg.Message}
+	}
+	challenge := challengeMsg.Challenge
+	signed := _authClientMessage(challenge, request.Nonce, string(rawRequest))
+	response := _authHashChallenge(signed, secret)
+	if request.Mode == "ed25519" {
+		response = base64.StdEncoding.EncodeToString(ed25519.Sign(opts.privateKey, []byte(signed)))
+	}
+	if err = _authWriteMessage(cl, response); err != nil {
+		return nil, resp, err
+	}
+	rawResponse, err := _authReadMessage(cl, maxHelloSize)
+	if err != nil {
+		return nil, resp, err
+	}
+	if err = json.Unmarshal([]byte(rawResponse), &resp); err != nil {
+		_ = cl.Close()
+		return nil, resp, err
+	}
+	if resp.Error != "" || resp.Bind == "" {
+		_ = cl.Close()
+		if resp.Error == "" {
+			resp.Error = protocol.ErrorBadRequest
+		}
+		return nil, resp, &TunnelError{Code: resp.Error, Message: resp.Message, Fields: resp.Errors}
+	}
+	proof, err := _authReadMessage(cl, maxResponseSize)
+	if err != nil {
+		return nil, resp, err
+	}
+	serverNonce := challenge[strings.LastIndex(challenge, ":")+1:]
+	message := _authProofMessage(request.Nonce, serverNonce, string(rawRequest), rawResponse)
+	ok := false
+	if request.Mode == "ed25519" {
+		signature, err := base64.StdEncoding.DecodeString(proof)
+		ok = err == nil && ed25519.Verify(opts.serverKey, []byte(message), signature)
+	} else {
+		ok = hmac.Equal([]byte(proof), []byte(_authHashChallenge(message, secret)))
+	}
+	if !ok {
+		_ = cl.Close()
+		return nil, resp, ErrServerIdentity
+	}
+	if err = cl.SetDeadline(time.Time{}); err != nil {
+		return nil, resp, err
+	}
+	if opts.encrypt {
+		if cl, err = _authSecureConn(cl, _authHashChallenge(_authSessionMessage(request.Nonce, serverNonce, string(rawRequest)), secret), true); err != nil {
+			return nil, resp, err
+		}
 	}
-	_, err = _authReadMessage(cl)
-	return protocol.NewReceiver(cl), protocol.NewSender(cl), err
+	return cl, resp, nil
 }
@@ -0,0 +1,200 @@
+package net
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"github.com/zbrumen/remote-serve/protocol"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func testServerAuth(conn net.Conn, auth Authenticator, opts *serverOptions) (net.Conn, *Identity, error) {
+	h, err := serverSideAuth(conn, auth, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	granted, errs, code := (&Server{}).grant(h.identity, h.request)
+	resp := protocol.TunnelResponse{Granted: granted, Errors: errs, Error: code}
+	if code == "" {
+		resp.Bind = h.request.Bind
+	}
+	var tunnel net.Conn
+	err = h.respond(resp, func(conn net.Conn) error {
+		tunnel = conn
+		return nil
+	})
+	return tunnel, h.identity, err
+}
+
+func TestMutualAuth(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	go func() {
+		_, _, _ = testServerAuth(server, StaticAuthenticator{"username": "password"}, &serverOptions{})
+	}()
+	if _, _, err := clientSideAuth(client, "username", "password", ":5000", &clientOptions{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientRejectsImpostor(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	go func() {
+		if _, err := _authReadMessage(server, maxResponseSize); err != nil {
+			return
+		}
+		if err := _authWriteMessage(server, `{"version":1,"challenge":"username:now:nonce"}`); err != nil {
+			return
+		}
+		if _, err := _authReadMessage(server, maxResponseSize); err != nil {
+			return
+		}
+		if err := _authWriteMessage(server, `{"version":1,"bind":":5000"}`); err != nil {
+			return
+		}
+		_ = _authWriteMessage(server, _authHashChallenge("anything", "guess"))
+	}()
+	if _, _, err := clientSideAuth(client, "username", "password", ":5000", &clientOptions{}); err == nil {
+		t.Fatal("client accepted a server that does not know the secret")
+	}
+}
+
+func TestEd25519Auth(t *testing.T) {
+	clientPublic, clientPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostPublic, hostPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := &serverOptions{
+		keys:    AuthorizedKeys{"device": clientPublic},
+		hostKey: hostPrivate,
+	}
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	go func() {
+		_, _, _ = testServerAuth(server, nil, opts)
+	}()
+	if _, _, err = clientSideAuth(client, "device", "", ":5000", &clientOptions{
+		privateKey: clientPrivate,
+		serverKey:  hostPublic,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	server, client = net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	go func() {
+		_, _, _ = testServerAuth(server, nil, &serverOptions{keys: opts.keys})
+	}()
+	if _, _, err = clientSideAuth(client, "device", "", ":5000", &clientOptions{
+		privateKey: clientPrivate,
+		serverKey:  hostPublic,
+	}); !errors.Is(err, ErrBadRequest) {
+		t.Fatal("server without a host key accepted an ed25519 client", err)
+	}
+
+	_, otherPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, client = net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	errs := make(chan error, 1)
+	go func() {
+		_, _, err := testServerAuth(server, nil, opts)
+		errs <- err
+	}()
+	_, _, _ = clientSideAuth(client, "device", "", ":5000", &clientOptions{
+		privateKey: otherPrivate,
+		serverKey:  hostPublic,
+	})
+	if <-errs == nil {
+		t.Fatal("server accepted a signature from an unauthorized key")
+	}
+}
+
+func TestEncryptedAuth(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	received := make(chan string, 1)
+	go func() {
+		tunnel, _, err := testServerAuth(server, StaticAuthenticator{"username": "password"}, &serverOptions{requireEncryption: true})
+		if err == nil {
+			cache := make([]byte, 6)
+			n, _ := io.ReadFull(tunnel, cache)
+			received <- string(cache[:n])
+		}
+		close(received)
+	}()
+	tunnel, _, err := clientSideAuth(client, "username", "password", ":5000", &clientOptions{encrypt: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tunnel.Write([]byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	if msg := <-received; msg != "secret" {
+		t.Fatal("message was not decrypted")
+	}
+}
+
+func TestServerRejectsRewrittenRequest(t *testing.T) {
+	server, mitmServer := net.Pipe()
+	mitmClient, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	go func() {
+		defer mitmServer.Close()
+		defer mitmClient.Close()
+		hello, err := _authReadMessage(mitmClient, maxHelloSize)
+		if err != nil {
+			return
+		}
+		var request protocol.TunnelRequest
+		if json.Unmarshal([]byte(hello), &request) != nil {
+			return
+		}
+		request.Bind = ":6000"
+		raw, _ := json.Marshal(request)
+		if _authWriteMessage(mitmServer, string(raw)) != nil {
+			return
+		}
+		go func() {
+			_, _ = io.Copy(mitmClient, mitmServer)
+		}()
+		_, _ = io.Copy(mitmServer, mitmClient)
+	}()
+	go func() {
+		_, _, _ = clientSideAuth(client, "username", "password", ":5000", &clientOptions{})
+	}()
+	if _, _, err := testServerAuth(server, StaticAuthenticator{"username": "password"}, &serverOptions{}); err == nil {
+		t.Fatal("server accepted an answer replayed with a rewritten request")
+	}
+}
+
+func TestLongKeyAuth(t *testing.T) {
+	key := strings.Repeat("k", 3000)
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	go func() {
+		_, _, _ = testServerAuth(server, StaticAuthenticator{key: "password"}, &serverOptions{})
+	}()
+	if _, _, err := clientSideAuth(client, key, "password", ":5000", &clientOptions{}); err != nil {
+		t.Fatal(err)
+	}
+}
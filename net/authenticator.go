@@ -0,0 +1,291 @@
+package net
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Identity is the result of a successful authentication. Binds restricts
+// the addresses the client may bind and Expires ends its tunnels, both are
+// unrestricted when empty. Dials are the destinations the server connects
+// forward tunnels to, none when empty.
+type Identity struct {
+	Key        string            `json:"key"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Binds      []string          `json:"binds,omitempty"`
+	Dials      []string          `json:"dials,omitempty"`
+	Expires    time.Time         `json:"expires"`
+}
+
+func (i *Identity) String() string {
+	return i.Key
+}
+
+func (i *Identity) CanBind(addr string) bool {
+	if len(i.Binds) == 0 {
+		return true
+	}
+	for _, bind := range i.Binds {
+		if bind == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// CanDial reports whether addr matches one of the Dials patterns. Patterns
+// are "*", "unix:/path" or host:port, where the host may be "*" or a CIDR
+// and the port "*". Unix sockets are only matched by their own path, "*"
+// covers network addresses alone.
+func (i *Identity) CanDial(addr string) bool {
+	return _dialAllowed(i.Dials, addr)
+}
+
+func _dialAllowed(patterns []string, addr string) bool {
+	if strings.HasPrefix(addr, "unix:") {
+		for _, pattern := range patterns {
+			if pattern == addr {
+				return true
+			}
+		}
+		return false
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	for _, pattern := range patterns {
+		if pattern == "*" {
+			return true
+		}
+		allowHost, allowPort, err := net.SplitHostPort(pattern)
+		if err != nil || (allowPort != "*" && allowPort != port) {
+			continue
+		}
+		if allowHost == "*" || strings.EqualFold(allowHost, host) {
+			return true
+		}
+		if _, network, err := net.ParseCIDR(allowHost); err == nil {
+			if ip := net.ParseIP(host); ip != nil && network.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Authenticator verifies the response a client gave to the server challenge.
+// The challenge it is passed is the message the client signed, the server
+// challenge bound to the client nonce and the tunnel request.
+type Authenticator interface {
+	Authenticate(key, challenge, response string) (*Identity, error)
+}
+
+// Prover is implemented by authenticators that can prove knowledge of a key's
+// secret back to the client, so clients can verify the server.
+type Prover interface {
+	Prove(key, message string) (string, error)
+}
+
+type StaticAuthenticator map[string]string
+
+func (s StaticAuthenticator) Authenticate(key, challenge, response string) (*Identity, error) {
+	secret, ok := s[key]
+	if !hmac.Equal([]byte(_authHashChallenge(challenge, secret)), []byte(response)) || !ok {
+		return nil, fmt.Errorf("unauthorized")
+	}
+	return &Identity{Key: key}, nil
+}
+
+func (s StaticAuthenticator) Prove(key, message string) (string, error) {
+	secret, ok := s[key]
+	if !ok {
+		return "", fmt.Errorf("no such key")
+	}
+	return _authHashChallenge(message, secret), nil
+}
+
+type fileEntry struct {
+	secret     string
+	attributes map[string]string
+}
+
+// FileAuthenticator reads "key:secret [name=value ...]" lines from a file and
+// reloads it whenever the file changes. A dials=a,b attribute fills
+// Identity.Dials.
+type FileAuthenticator struct {
+	path string
+
+	modified time.Time
+	entries  map[string]fileEntry
+	sync     sync.Mutex
+}
+
+func (f *FileAuthenticator) load() error {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(f.modified) && f.entries != nil {
+		return nil
+	}
+	file, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	entries := make(map[string]fileEntry)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		key, secret, ok := strings.Cut(fields[0], ":")
+		if !ok || key == "" {
+			return fmt.Errorf("%s:%d: expected key:secret", f.path, line)
+		}
+		entry := fileEntry{secret: secret, attributes: make(map[string]string)}
+		for _, attr := range fields[1:] {
+			name, value, ok := strings.Cut(attr, "=")
+			if !ok {
+				return fmt.Errorf("%s:%d: expected name=value", f.path, line)
+			}
+			entry.attributes[name] = value
+		}
+		entries[key] = entry
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	f.entries = entries
+	f.modified = info.ModTime()
+	return nil
+}
+
+func (f *FileAuthenticator) lookup(key string) (fileEntry, bool, error) {
+	f.sync.Lock()
+	defer f.sync.Unlock()
+	if err := f.load(); err != nil {
+		return fileEntry{}, false, err
+	}
+	entry, ok := f.entries[key]
+	return entry, ok, nil
+}
+
+func (f *FileAuthenticator) Authenticate(key, challenge, response string) (*Identity, error) {
+	entry, ok, err := f.lookup(key)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal([]byte(_authHashChallenge(challenge, entry.secret)), []byte(response)) || !ok {
+		return nil, fmt.Errorf("unauthorized")
+	}
+	out := &Identity{Key: key, Attributes: entry.attributes}
+	if dials := entry.attributes["dials"]; dials != "" {
+		out.Dials = strings.Split(dials, ",")
+	}
+	return out, nil
+}
+
+func (f *FileAuthenticator) Prove(key, message string) (string, error) {
+	entry, ok, err := f.lookup(key)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", fmt.Errorf("no such key")
+	}
+	return _authHashChallenge(message, entry.secret), nil
+}
+
+func NewFileAuthenticator(path string) (*FileAuthenticator, error) {
+	out := &FileAuthenticator{path: path}
+	if err := out.load(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+type webhookRequest struct {
+	Action    string `json:"action"`
+	Key       string `json:"key"`
+	Challenge string `json:"challenge,omitempty"`
+	Response  string `json:"response,omitempty"`
+	Message   string `json:"message,omitempty"`
+}
+
+type webhookProof struct {
+	Proof string `json:"proof"`
+}
+
+// WebhookAuthenticator posts every authentication attempt as JSON to an HTTP
+// endpoint. A 200 response carrying an Identity accepts the client, anything
+// else rejects it. Requests with the "prove" action must be answered with the
+// hex HMAC-SHA256 of the message under the key's secret.
+type WebhookAuthenticator struct {
+	url    string
+	client *http.Client
+}
+
+func (w *WebhookAuthenticator) post(req webhookRequest, out interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unauthorized")
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (w *WebhookAuthenticator) Authenticate(key, challenge, response string) (*Identity, error) {
+	var out Identity
+	err := w.post(webhookRequest{
+		Action:    "authenticate",
+		Key:       key,
+		Challenge: challenge,
+		Response:  response,
+	}, &out)
+	if err != nil {
+		return nil, err
+	}
+	if out.Key == "" {
+		out.Key = key
+	}
+	return &out, nil
+}
+
+func (w *WebhookAuthenticator) Prove(key, message string) (string, error) {
+	var out webhookProof
+	err := w.post(webhookRequest{
+		Action:  "prove",
+		Key:     key,
+		Message: message,
+	}, &out)
+	return out.Proof, err
+}
+
+func NewWebhookAuthenticator(url string, client *http.Client) *WebhookAuthenticator {
+	if client == nil {
+		client = &http.Client{Timeout: time.Second * 10}
+	}
+	return &WebhookAuthenticator{
+		url:    url,
+		client: client,
+	}
+}
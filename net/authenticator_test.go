@@ -0,0 +1,96 @@
+package net
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStaticAuthenticator(t *testing.T) {
+	auth := StaticAuthenticator{"username": "password"}
+	identity, err := auth.Authenticate("username", "challenge", _authHashChallenge("challenge", "password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Key != "username" {
+		t.Fatal("wrong identity " + identity.Key)
+	}
+	if _, err = auth.Authenticate("username", "challenge", _authHashChallenge("challenge", "wrong")); err == nil {
+		t.Fatal("wrong secret accepted")
+	}
+	if _, err = auth.Authenticate("nobody", "challenge", _authHashChallenge("challenge", "password")); err == nil {
+		t.Fatal("unknown key accepted")
+	}
+}
+
+func TestFileAuthenticator(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "auths")
+	if err := os.WriteFile(path, []byte("# users\nusername:password team=backend\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	auth, err := NewFileAuthenticator(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity, err := auth.Authenticate("username", "challenge", _authHashChallenge("challenge", "password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Attributes["team"] != "backend" {
+		t.Fatal("missing attribute")
+	}
+	if _, err = auth.Authenticate("username", "challenge", "bad"); err == nil {
+		t.Fatal("wrong response accepted")
+	}
+	proof, err := auth.Prove("username", "message")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proof != _authHashChallenge("message", "password") {
+		t.Fatal("wrong proof")
+	}
+}
+
+func TestWebhookAuthenticator(t *testing.T) {
+	srvr := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		var req webhookRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if req.Action == "prove" {
+			_ = json.NewEncoder(rw).Encode(webhookProof{Proof: _authHashChallenge(req.Message, "password")})
+			return
+		}
+		if req.Key != "username" || req.Response != _authHashChallenge(req.Challenge, "password") {
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_ = json.NewEncoder(rw).Encode(Identity{
+			Key:        req.Key,
+			Attributes: map[string]string{"role": "admin"},
+		})
+	}))
+	defer srvr.Close()
+	auth := NewWebhookAuthenticator(srvr.URL, srvr.Client())
+	identity, err := auth.Authenticate("username", "challenge", _authHashChallenge("challenge", "password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Attributes["role"] != "admin" {
+		t.Fatal("missing attribute")
+	}
+	if _, err = auth.Authenticate("username", "challenge", "bad"); err == nil {
+		t.Fatal("wrong response accepted")
+	}
+	proof, err := auth.Prove("username", "message")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proof != _authHashChallenge("message", "password") {
+		t.Fatal("wrong proof")
+	}
+}
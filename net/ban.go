@@ -0,0 +1,267 @@
+package net
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// SourceLimits controls how the server bans public sources that hammer its
+// tunnels. Within Window a source may open MaxConnections connections to a
+// single tunnel and fail MaxFailures times, a failure being a connection it
+// resets or closes within QuickClose without sending anything. Sources over
+// either limit are banned from every tunnel for BanFor.
+type SourceLimits struct {
+	Window         time.Duration
+	MaxConnections int
+	MaxFailures    int
+	QuickClose     time.Duration
+	BanFor         time.Duration
+}
+
+var DefaultSourceLimits = SourceLimits{
+	Window:         time.Minute,
+	MaxConnections: 120,
+	MaxFailures:    20,
+	QuickClose:     time.Second,
+	BanFor:         time.Minute * 15,
+}
+
+// Ban keeps a public source away from every tunnel until it expires.
+type Ban struct {
+	Source string    `json:"source"`
+	Until  time.Time `json:"until"`
+	Reason string    `json:"reason"`
+}
+
+type sourceCounter struct {
+	start       time.Time
+	connections int
+	failures    int
+}
+
+// sourceTunnel names the counter of a source on a single tunnel.
+type sourceTunnel struct {
+	bind   string
+	source netip.Addr
+}
+
+type sourceBans struct {
+	limits SourceLimits
+
+	counters map[sourceTunnel]*sourceCounter
+	bans     map[netip.Addr]Ban
+	sync     sync.Mutex
+}
+
+func (b *sourceBans) _ban(source netip.Addr, until time.Time, reason string) {
+	b.bans[source] = Ban{Source: source.String(), Until: until, Reason: reason}
+	fmt.Println("remote-serve: BANNED " + source.String() + " UNTIL " + until.Format(time.RFC3339) + ": " + reason)
+}
+
+// _counter returns the counter of source on the tunnel bound to bind, it
+// starts over once the window passed.
+func (b *sourceBans) _counter(bind string, source netip.Addr, now time.Time) *sourceCounter {
+	name := sourceTunnel{bind: bind, source: source}
+	counter, ok := b.counters[name]
+	if !ok || now.Sub(counter.start) > b.limits.Window {
+		counter = &sourceCounter{start: now}
+		b.counters[name] = counter
+	}
+	return counter
+}
+
+func (b *sourceBans) banned(source netip.Addr) bool {
+	if b == nil {
+		return false
+	}
+	b.sync.Lock()
+	defer b.sync.Unlock()
+	ban, ok := b.bans[source]
+	return ok && time.Now().Before(ban.Until)
+}
+
+// connect counts a connection of source to the tunnel bound to bind and
+// reports whether the source is allowed to make it.
+func (b *sourceBans) connect(bind string, source netip.Addr) bool {
+	if b == nil {
+		return true
+	}
+	b.sync.Lock()
+	defer b.sync.Unlock()
+	now := time.Now()
+	if ban, ok := b.bans[source]; ok && now.Before(ban.Until) {
+		return false
+	}
+	counter := b._counter(bind, source, now)
+	counter.connections++
+	if b.limits.MaxConnections > 0 && counter.connections > b.limits.MaxConnections {
+		b._ban(source, now.Add(b.limits.BanFor), fmt.Sprintf("more than %d connections to %s within %s", b.limits.MaxConnections, bind, b.limits.Window))
+		return false
+	}
+	return true
+}
+
+// fail counts a connection of source to the tunnel bound to bind that was
+// reset or closed right away.
+func (b *sourceBans) fail(bind string, source netip.Addr) {
+	if b == nil {
+		return
+	}
+	b.sync.Lock()
+	defer b.sync.Unlock()
+	now := time.Now()
+	counter := b._counter(bind, source, now)
+	counter.failures++
+	if b.limits.MaxFailures > 0 && counter.failures >= b.limits.MaxFailures {
+		b._ban(source, now.Add(b.limits.BanFor), fmt.Sprintf("%d failed connections to %s within %s", counter.failures, bind, b.limits.Window))
+		counter.failures = 0
+	}
+}
+
+func (b *sourceBans) cleanup() {
+	b.sync.Lock()
+	defer b.sync.Unlock()
+	now := time.Now()
+	for name, counter := range b.counters {
+		if now.Sub(counter.start) > b.limits.Window {
+			delete(b.counters, name)
+		}
+	}
+	for source, ban := range b.bans {
+		if !now.Before(ban.Until) {
+			delete(b.bans, source)
+		}
+	}
+}
+
+func newSourceBans(limits SourceLimits) *sourceBans {
+	return &sourceBans{
+		limits:   limits,
+		counters: make(map[sourceTunnel]*sourceCounter),
+		bans:     make(map[netip.Addr]Ban),
+	}
+}
+
+// _quickFailure tells whether a public connection that sent read bytes
+// before ending with err after lived looks like a scanner.
+func _quickFailure(limits SourceLimits, read int64, err error, lived time.Duration) bool {
+	if errors.Is(err, syscall.ECONNRESET) {
+		return true
+	}
+	return errors.Is(err, io.EOF) && read == 0 && lived < limits.QuickClose
+}
+
+// Bans lists the sources that are banned right now.
+func (s *Server) Bans() []Ban {
+	if s.bans == nil {
+		return nil
+	}
+	s.bans.sync.Lock()
+	defer s.bans.sync.Unlock()
+	now := time.Now()
+	var out []Ban
+	for _, ban := range s.bans.bans {
+		if now.Before(ban.Until) {
+			out = append(out, ban)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Source < out[j].Source
+	})
+	return out
+}
+
+// Ban keeps source, an IP, away from every tunnel for duration. It needs
+// WithSourceLimits.
+func (s *Server) Ban(source string, duration time.Duration, reason string) error {
+	if s.bans == nil {
+		return fmt.Errorf("source bans are not enabled")
+	}
+	addr, err := netip.ParseAddr(source)
+	if err != nil {
+		return fmt.Errorf("invalid source %s", source)
+	}
+	s.bans.sync.Lock()
+	defer s.bans.sync.Unlock()
+	s.bans._ban(addr.Unmap(), time.Now().Add(duration), reason)
+	return nil
+}
+
+// Unban lifts the ban of source and forgets its counters, it reports whether
+// source was banned.
+func (s *Server) Unban(source string) bool {
+	addr, err := netip.ParseAddr(source)
+	if s.bans == nil || err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	s.bans.sync.Lock()
+	defer s.bans.sync.Unlock()
+	ban, ok := s.bans.bans[addr]
+	delete(s.bans.bans, addr)
+	for name := range s.bans.counters {
+		if name.source == addr {
+			delete(s.bans.counters, name)
+		}
+	}
+	return ok && time.Now().Before(ban.Until)
+}
+
+// BansHandler lists the bans as JSON on GET and lifts the ban of the source
+// query parameter on DELETE. It has no authentication of its own and must
+// only be served to administrators.
+func (s *Server) BansHandler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			bans := s.Bans()
+			if bans == nil {
+				bans = []Ban{}
+			}
+			rw.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(rw).Encode(bans)
+		case http.MethodDelete:
+			if !s.Unban(r.URL.Query().Get("source")) {
+				http.Error(rw, "source is not banned", http.StatusNotFound)
+				return
+			}
+			rw.WriteHeader(http.StatusNoContent)
+		default:
+			rw.Header().Set("Allow", "GET, DELETE")
+			http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+func (s *serverConn) bannedSource(addr net.Addr) bool {
+	ip, ok := _sourceAddr(addr)
+	return ok && s.server.bans.banned(ip)
+}
+
+// admitSource applies the source bans and policies to a new public source.
+func (s *serverConn) admitSource(addr net.Addr) bool {
+	if ip, ok := _sourceAddr(addr); ok && !s.server.bans.connect(s.bind, ip) {
+		return false
+	}
+	return s.allowSource(addr)
+}
+
+// reportSource counts a public connection that ended like a scan against
+// its source.
+func (s *serverConn) reportSource(addr net.Addr, read int64, err error, lived time.Duration) {
+	if s.server.bans == nil || !_quickFailure(s.server.bans.limits, read, err, lived) {
+		return
+	}
+	if ip, ok := _sourceAddr(addr); ok {
+		s.server.bans.fail(s.bind, ip)
+	}
+}
@@ -0,0 +1,167 @@
+package net
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSourceBans(t *testing.T) {
+	srvr, err := NewServer("127.0.0.1:0", StaticAuthenticator{"username": "password"}, WithSourceLimits(SourceLimits{
+		Window:         time.Minute,
+		MaxConnections: 2,
+		BanFor:         time.Minute,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srvr.Close()
+	client, err := NewClient("tcp", srvr.Addr().String(), "username", "password", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	target := echoServer(t)
+	go func() {
+		_ = client.Forward("tcp", target.Addr().String())
+	}()
+	for i := 0; i < 2; i++ {
+		public, err := net.Dial("tcp", client.Tunnel().Bind)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectEcho(t, public)
+		_ = public.Close()
+	}
+	public, err := net.Dial("tcp", client.Tunnel().Bind)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer public.Close()
+	expectClosed(t, public)
+
+	handler := httptest.NewServer(srvr.BansHandler())
+	defer handler.Close()
+	resp, err := http.Get(handler.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bans []Ban
+	err = json.NewDecoder(resp.Body).Decode(&bans)
+	_ = resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bans) != 1 || bans[0].Source != "127.0.0.1" || bans[0].Reason == "" {
+		t.Fatalf("unexpected bans %+v", bans)
+	}
+	req, _ := http.NewRequest(http.MethodDelete, handler.URL+"?source=127.0.0.1", nil)
+	if resp, err = http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent || len(srvr.Bans()) != 0 {
+		t.Fatal("ban was not lifted", resp.Status)
+	}
+	public, err = net.Dial("tcp", client.Tunnel().Bind)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer public.Close()
+	expectEcho(t, public)
+
+	if err = srvr.Ban("192.0.2.1", time.Millisecond*10, "manual"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 20)
+	if len(srvr.Bans()) != 0 {
+		t.Fatal("ban did not expire")
+	}
+}
+
+func TestSourceBansFailures(t *testing.T) {
+	srvr, err := NewServer("127.0.0.1:0", StaticAuthenticator{"username": "password"}, WithSourceLimits(SourceLimits{
+		Window:      time.Minute,
+		MaxFailures: 2,
+		QuickClose:  time.Second * 5,
+		BanFor:      time.Minute,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srvr.Close()
+	client, err := NewClient("tcp", srvr.Addr().String(), "username", "password", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	// keep the accepted connections open, the public side has to close first
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := client.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+	for i := 0; i < 2; i++ {
+		public, err := net.Dial("tcp", client.Tunnel().Bind)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = public.Close()
+	}
+	for start := time.Now(); len(srvr.Bans()) == 0; time.Sleep(time.Millisecond * 20) {
+		if time.Since(start) > time.Second*5 {
+			t.Fatal("source closing its connections right away was not banned")
+		}
+	}
+}
+
+func TestForwardedDestinationsAreNotBanned(t *testing.T) {
+	closing, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closing.Close()
+	go func() {
+		for {
+			conn, err := closing.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+		}
+	}()
+	srvr, err := NewServer("127.0.0.1:0", StaticAuthenticator{"username": "password"}, WithDialAllowlist(map[string][]string{
+		"username": {closing.Addr().String()},
+	}), WithSourceLimits(SourceLimits{
+		Window:      time.Minute,
+		MaxFailures: 1,
+		QuickClose:  time.Minute,
+		BanFor:      time.Minute,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srvr.Close()
+	client, err := NewClient("tcp", srvr.Addr().String(), "username", "password", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := client.Dial("tcp", closing.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	expectClosed(t, conn)
+	if bans := srvr.Bans(); len(bans) != 0 {
+		t.Fatalf("destination of a forward was banned %+v", bans)
+	}
+}
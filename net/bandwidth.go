@@ -0,0 +1,135 @@
+package net
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Bandwidth limits the bytes per second a tunnel moves towards its client
+// and back from it, zero is unlimited. A limit allows bursts of one second.
+type Bandwidth struct {
+	ToClient   int64
+	FromClient int64
+}
+
+// tokenBucket hands out bytes at rate per second, taking more than it holds
+// puts it into debt the caller waits for.
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+	sync   sync.Mutex
+}
+
+func newTokenBucket(rate int64) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &tokenBucket{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// take reserves n bytes and returns how long the caller has to wait before
+// sending them.
+func (b *tokenBucket) take(n int, now time.Time) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.sync.Lock()
+	defer b.sync.Unlock()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+type bandwidthBuckets struct {
+	toClient   *tokenBucket
+	fromClient *tokenBucket
+}
+
+func newBandwidthBuckets(limit Bandwidth) *bandwidthBuckets {
+	if limit == (Bandwidth{}) {
+		return nil
+	}
+	return &bandwidthBuckets{
+		toClient:   newTokenBucket(limit.ToClient),
+		fromClient: newTokenBucket(limit.FromClient),
+	}
+}
+
+func (b *bandwidthBuckets) take(toClient bool, n int, now time.Time) time.Duration {
+	if b == nil {
+		return 0
+	}
+	if toClient {
+		return b.toClient.take(n, now)
+	}
+	return b.fromClient.take(n, now)
+}
+
+// _bandwidthFor looks up the limit of key, "*" applies to keys without one.
+func _bandwidthFor(limits map[string]Bandwidth, key string) Bandwidth {
+	if limit, ok := limits[key]; ok {
+		return limit
+	}
+	return limits["*"]
+}
+
+// keyBandwidth shares one set of buckets between every tunnel of a key.
+type keyBandwidth struct {
+	limits  map[string]Bandwidth
+	buckets map[string]*bandwidthBuckets
+	sync    sync.Mutex
+}
+
+func (k *keyBandwidth) get(key string) *bandwidthBuckets {
+	k.sync.Lock()
+	defer k.sync.Unlock()
+	if buckets, ok := k.buckets[key]; ok {
+		return buckets
+	}
+	buckets := newBandwidthBuckets(_bandwidthFor(k.limits, key))
+	k.buckets[key] = buckets
+	return buckets
+}
+
+func newKeyBandwidth(limits map[string]Bandwidth) *keyBandwidth {
+	return &keyBandwidth{
+		limits:  limits,
+		buckets: make(map[string]*bandwidthBuckets),
+	}
+}
+
+// throttle waits until the tunnel and its key may move n more bytes and
+// counts them against the quota of the key. It returns false once the
+// tunnel is closed, which it is when the quota is exceeded.
+func (s *serverConn) throttle(toClient bool, n int) bool {
+	now := time.Now()
+	if err := s.server.quotas.add(s.identity.Key, toClient, int64(n), now); err != nil {
+		fmt.Println("remote-serve: " + s.name + " EXCEEDED ITS QUOTA")
+		s.closeWithReason(err.Error())
+		return false
+	}
+	wait := s.bandwidth.take(toClient, n, now)
+	if keyWait := s.keyBandwidth.take(toClient, n, now); keyWait > wait {
+		wait = keyWait
+	}
+	if wait <= 0 {
+		return true
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-s.background.Done():
+		return false
+	}
+}
@@ -0,0 +1,114 @@
+package net
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	bucket := newTokenBucket(1000)
+	bucket.last = now
+	if wait := bucket.take(1000, now); wait != 0 {
+		t.Fatal("full bucket made the caller wait", wait)
+	}
+	if wait := bucket.take(500, now); wait != time.Millisecond*500 {
+		t.Fatal("unexpected wait", wait)
+	}
+	if wait := bucket.take(500, now.Add(time.Second*2)); wait != 0 {
+		t.Fatal("refilled bucket made the caller wait", wait)
+	}
+	if newTokenBucket(0).take(1<<20, now) != 0 {
+		t.Fatal("unlimited bucket made the caller wait")
+	}
+}
+
+func TestBandwidth(t *testing.T) {
+	srvr, err := NewServer("127.0.0.1:0", StaticAuthenticator{"username": "password"}, WithKeyBandwidth(map[string]Bandwidth{
+		"*": {ToClient: 32 * 1024},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srvr.Close()
+	client, err := NewClient("tcp", srvr.Addr().String(), "username", "password", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	target := echoServer(t)
+	go func() {
+		_ = client.Forward("tcp", target.Addr().String())
+	}()
+	public, err := net.Dial("tcp", client.Tunnel().Bind)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer public.Close()
+	payload := bytes.Repeat([]byte("x"), 64*1024)
+	start := time.Now()
+	go func() {
+		_, _ = public.Write(payload)
+	}()
+	if _, err = io.ReadFull(public, make([]byte, len(payload))); err != nil {
+		t.Fatal(err)
+	}
+	// the first 32KB are a burst, the second have to wait a second
+	if elapsed := time.Since(start); elapsed < time.Millisecond*800 {
+		t.Fatal("bandwidth limit was not applied, took", elapsed)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "quotas.json")
+	quotas := map[string]Quota{"username": {ToClient: 1024, Window: time.Hour}}
+	srvr, err := NewServer("127.0.0.1:0", StaticAuthenticator{"username": "password"}, WithQuotas(quotas, file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewClient("tcp", srvr.Addr().String(), "username", "password", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	target := echoServer(t)
+	closed := make(chan error, 1)
+	go func() {
+		closed <- client.Forward("tcp", target.Addr().String())
+	}()
+	public, err := net.Dial("tcp", client.Tunnel().Bind)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer public.Close()
+	expectEcho(t, public)
+	if _, err = public.Write(bytes.Repeat([]byte("x"), 2048)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err = <-closed:
+		if !strings.Contains(err.Error(), "quota of 1024 bytes to the client per 1h0m0s exceeded") {
+			t.Fatal("tunnel closed without the quota reason", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("tunnel exceeding its quota was not closed")
+	}
+	_ = srvr.Close()
+
+	// the usage survives restarting the server
+	srvr, err = NewServer("127.0.0.1:0", StaticAuthenticator{"username": "password"}, WithQuotas(quotas, file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srvr.Close()
+	_, err = NewClient("tcp", srvr.Addr().String(), "username", "password", "127.0.0.1:0")
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatal("expected the quota to be exceeded, got", err)
+	}
+}
@@ -1,87 +1,195 @@
 package net
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"github.com/zbrumen/remote-serve/protocol"
 	"net"
-	"sync"
 )
 
 type Client struct {
-	serverRequests  protocol.Receiver
-	serverResponder protocol.Sender
-	serverConn      net.Conn
+	session    *protocol.Session
+	serverConn net.Conn
+	tunnel     protocol.TunnelResponse
+	options    clientOptions
 
-	conns chan *clientConn
-
-	connections map[string]*clientConn
-	c_sync      sync.RWMutex
+	conns   chan net.Conn
+	packets *packetConn
 }
 
 func (c *Client) backend() {
-	for req := range c.serverRequests.Receive() {
-		switch req.Type {
-		case "create":
-			conn, err := newClientConn(req, c.serverResponder)
-			if err != nil {
-				fmt.Println("remote-server-client: CONNECTION ERROR: " + err.Error())
-			} else {
-				c.c_sync.Lock()
-				c.connections[req.Id] = conn
-				c.c_sync.Unlock()
-				c.conns <- conn
+	for {
+		stream, err := c.session.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		var header protocol.StreamHeader
+		if err = json.Unmarshal(stream.Header(), &header); err != nil {
+			_ = stream.CloseWithReason("malformed stream header")
+			continue
+		}
+		if header.Type == "dial" {
+			go c.forward(stream, header)
+			continue
+		}
+		if header.Type == "udp" {
+			remote, err := protocol.DecodeAddr(header.Remote)
+			if err != nil || c.packets == nil {
+				_ = stream.CloseWithReason("not a udp tunnel")
+				continue
 			}
-		default:
-			if req.Data.Id != "" {
-				c.c_sync.Lock()
-				if conn := c.connections[req.Data.Id]; conn != nil {
-					closed := conn.handleMessages(req)
-					if closed {
-						go func() {
-							_ = conn.Close()
-						}()
-						delete(c.connections, req.Data.Id)
-					}
-				}
-				c.c_sync.Unlock()
+			if c.refuse(stream, c.packets.LocalAddr(), remote) {
+				continue
 			}
+			go c.packets.serve(stream, remote)
+			continue
+		}
+		conn, err := newTunnelConn(stream, header)
+		if err != nil {
+			fmt.Println("remote-server-client: CONNECTION ERROR: " + err.Error())
+			_ = stream.CloseWithReason(err.Error())
+			continue
+		}
+		if c.refuse(stream, conn.LocalAddr(), conn.RemoteAddr()) {
+			continue
+		}
+		// never wait for Accept, that would hold up every other stream
+		select {
+		case c.conns <- conn:
+		default:
+			fmt.Println("remote-server-client: ACCEPT BACKLOG IS FULL, REFUSING " + conn.RemoteAddr().String())
+			_ = stream.CloseWithReason("accept backlog is full")
 		}
 	}
-	close(c.conns)
+}
+
+// refuse closes the stream of a public connection the accept filter rejects.
+func (c *Client) refuse(stream *protocol.Stream, local, remote net.Addr) bool {
+	if c.options.acceptFilter == nil {
+		return false
+	}
+	if err := c.options.acceptFilter(local, remote); err != nil {
+		_ = stream.CloseWithReason(err.Error())
+		return true
+	}
+	return false
+}
+
+func (c *Client) forward(stream *protocol.Stream, header protocol.StreamHeader) {
+	if conn := acceptDial(context.Background(), stream, header, c.allowDial); conn != nil {
+		join(stream, conn)
+	}
 }
 
 func (c *Client) Accept() (net.Conn, error) {
-	out, ok := <-c.conns
-	if !ok {
-		return nil, fmt.Errorf("closed")
+	select {
+	case out := <-c.conns:
+		return out, nil
+	case <-c.session.Done():
+		return nil, c.session.Err()
 	}
-	return out, nil
 }
 
 func (c *Client) Close() error {
-	return c.serverRequests.Close()
+	if c.packets != nil {
+		_ = c.packets.Close()
+	}
+	return c.session.Close()
+}
+
+// PacketConn reads and answers the datagrams of a udp tunnel, requested with
+// the "udp" protocol in WithTunnelOptions.
+func (c *Client) PacketConn() (net.PacketConn, error) {
+	if c.packets == nil {
+		return nil, fmt.Errorf("tunnel protocol is %s", c.tunnel.Granted.Protocol)
+	}
+	return c.packets, nil
 }
 
 func (c *Client) Addr() net.Addr {
 	return c.serverConn.RemoteAddr()
 }
 
-func NewClient(network, addr, key, secret, port string) (net.Listener, error) {
-	conn, err := net.Dial(network, addr)
+// Tunnel is the server response to the tunnel request, it holds the bound
+// address, the granted options and errors for options that were refused.
+func (c *Client) Tunnel() protocol.TunnelResponse {
+	return c.tunnel
+}
+
+func NewClient(network, addr, key, secret, port string, opts ...ClientOption) (*Client, error) {
+	return NewClientContext(context.Background(), network, addr, key, secret, port, opts...)
+}
+
+// NewClientContext is NewClient that gives up connecting and authenticating
+// once ctx is done.
+func NewClientContext(ctx context.Context, network, addr, key, secret, port string, opts ...ClientOption) (*Client, error) {
+	options := defaultClientOptions()
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if options.acceptBacklog < 0 {
+		options.acceptBacklog = 0
+	}
+	if options.connectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, options.connectTimeout)
+		defer cancel()
+	}
+	dial := options.dial
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	conn, err := dial(ctx, network, addr)
 	if err != nil {
 		return nil, err
 	}
-	recv, resp, err := clientSideAuth(conn, key, secret, port)
+	if options.tls != nil {
+		config := options.tls.Clone()
+		if config.ServerName == "" {
+			config.ServerName, _, _ = net.SplitHostPort(addr)
+		}
+		secure := tls.Client(conn, config)
+		if err = secure.HandshakeContext(ctx); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		conn = secure
+	}
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+		case <-stop:
+		}
+	}()
+	tunneled, tunnel, err := clientSideAuth(conn, key, secret, port, &options)
+	close(stop)
+	<-stopped
+	if err == nil {
+		err = ctx.Err()
+	}
 	if err != nil {
+		_ = conn.Close()
 		return nil, err
 	}
 	out := &Client{
-		serverRequests:  recv,
-		serverResponder: resp,
-		serverConn:      conn,
-		conns:           make(chan *clientConn, 8),
-		connections:     make(map[string]*clientConn),
-		c_sync:          sync.RWMutex{},
+		session:    protocol.NewSession(tunneled, true, protocol.WithSessionMaxFrameSize(options.maxFrameSize)),
+		serverConn: conn,
+		tunnel:     tunnel,
+		options:    options,
+		conns:      make(chan net.Conn, options.acceptBacklog),
+	}
+	if tunnel.Granted.Protocol == "udp" {
+		local, err := net.ResolveUDPAddr("udp", tunnel.Bind)
+		if err != nil {
+			_ = out.session.Close()
+			return nil, err
+		}
+		out.packets = newPacketConn(local)
 	}
 	go out.backend()
 	return out, nil
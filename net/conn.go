@@ -1,139 +1,72 @@
 package net
 
 import (
-	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/zbrumen/remote-serve/protocol"
+	"io"
 	"net"
 	"sync"
 	"time"
 )
 
-type clientConn struct {
-	local  protocol.Addr
-	remote protocol.Addr
+// tunnelConn is a stream that reports the addresses of the public
+// connection it carries.
+type tunnelConn struct {
+	*protocol.Stream
 
-	cancel context.CancelFunc
-	close  sync.Once
-
-	background context.Context
-
-	responder protocol.Sender
-	requestId string
-
-	readStream *bytes.Buffer
+	local  net.Addr
+	remote net.Addr
 }
 
-func newClientConn(msg protocol.Message, sender protocol.Sender) (*clientConn, error) {
-	remote, err := protocol.DecodeAddr(msg.Data.Id)
+func newTunnelConn(stream *protocol.Stream, header protocol.StreamHeader) (*tunnelConn, error) {
+	if header.Type != "tcp" {
+		return nil, fmt.Errorf("unsupported stream type %s", header.Type)
+	}
+	remote, err := protocol.DecodeAddr(header.Remote)
 	if err != nil {
 		return nil, err
 	}
-	local, err := protocol.DecodeAddr(string(msg.Data.Data))
+	local, err := protocol.DecodeAddr(header.Local)
 	if err != nil {
 		return nil, err
 	}
-	background, cancel := context.WithCancel(context.Background())
-	return &clientConn{
-		local:      local,
-		remote:     remote,
-		cancel:     cancel,
-		close:      sync.Once{},
-		background: background,
-		responder:  sender,
-		requestId:  msg.Id,
-		readStream: bytes.NewBuffer(nil),
+	return &tunnelConn{
+		Stream: stream,
+		local:  local,
+		remote: remote,
 	}, nil
 }
 
-func (c *clientConn) Read(b []byte) (n int, err error) {
-	n, err = c.readStream.Read(b)
-	return n, err
-}
-
-func (c *clientConn) Write(b []byte) (n int, err error) {
-	n = len(b)
-	return n, c.responder.Send(c.background, protocol.NewMessage("write", protocol.MessageData{
-		Id:   c.requestId,
-		Data: b,
-	}))
-}
-
-func (c *clientConn) Close() error {
-	err := fmt.Errorf("already closed")
-	c.close.Do(func() {
-		err = c.responder.Send(c.background, protocol.NewMessage("close", protocol.MessageData{
-			Id:    c.requestId,
-			Close: true,
-		}))
-		if err == nil {
-			c.cancel()
-		} else {
-			c.close = sync.Once{}
-		}
-	})
-	return err
-}
-
-func (c *clientConn) LocalAddr() net.Addr {
+func (c *tunnelConn) LocalAddr() net.Addr {
 	return c.local
 }
 
-func (c *clientConn) RemoteAddr() net.Addr {
+func (c *tunnelConn) RemoteAddr() net.Addr {
 	return c.remote
 }
 
-func (c *clientConn) SetDeadline(t time.Time) error {
-	return c.responder.Send(c.background, protocol.NewMessage("set_deadline", protocol.MessageData{
-		Id:       c.requestId,
-		Deadline: t,
-	}))
-}
-
-func (c *clientConn) SetReadDeadline(t time.Time) error {
-	return c.responder.Send(c.background, protocol.NewMessage("set_read_deadline", protocol.MessageData{
-		Id:       c.requestId,
-		Deadline: t,
-	}))
-}
-
-func (c *clientConn) SetWriteDeadline(t time.Time) error {
-	return c.responder.Send(c.background, protocol.NewMessage("set_write_deadline", protocol.MessageData{
-		Id:       c.requestId,
-		Deadline: t,
-	}))
-}
-
-func (c *clientConn) handleMessages(msg protocol.Message) (closed bool) {
-	switch msg.Type {
-	case "close":
-		_ = c.Close()
-		return true
-	case "write":
-		_, err := c.readStream.Write(msg.Data.Data)
-		if err != nil {
-			_ = c.Close()
-			return true
-		}
-		return false
-	default:
-		fmt.Println("client.Connection received unknown msg.Type: " + msg.Type)
-		return false
-	}
-}
-
 type serverConn struct {
+	bind     string
 	listener net.Listener
+	packets  net.PacketConn
 
-	name string
-
-	conns map[string]net.Conn
-	sync  sync.RWMutex
+	identity *Identity
+	options  protocol.TunnelOptions
+	server   *Server
+	name     string
 
-	clientRequests  protocol.Sender
-	clientResponses protocol.Receiver
+	session      *protocol.Session
+	bandwidth    *bandwidthBuckets
+	keyBandwidth *bandwidthBuckets
+	sources      []*sourceFilter
+	udp          map[string]*udpSession
+	streams      int
+	sync         sync.Mutex
 
+	// ready is closed once the client got the proof and streams may be opened
+	ready      chan struct{}
 	background context.Context
 	close      context.CancelFunc
 }
@@ -145,175 +78,215 @@ func (s *serverConn) backend() {
 			_ = s.Close()
 			return
 		}
-		msg := protocol.NewMessage("create", protocol.MessageData{
-			Id:       protocol.NewAddr(conn.RemoteAddr()).Encode(),
-			Data:     []byte(protocol.NewAddr(conn.LocalAddr()).Encode()),
-			Deadline: time.Now(),
-			Close:    false,
-		})
-		if s.clientRequests != nil {
-			err = s.clientRequests.Send(context.Background(), msg)
-		} else {
-			err = fmt.Errorf("no client connected")
+		if s.bannedSource(conn.RemoteAddr()) {
+			_ = conn.Close()
+			continue
 		}
-		if err != nil {
-			fmt.Println("remote-serve: NO CLIENT CONNECTED FOR NEW CONNECTION")
+		if !s.admitSource(conn.RemoteAddr()) {
+			fmt.Println("remote-serve: " + s.name + " REFUSED SOURCE " + conn.RemoteAddr().String())
+			_ = conn.Close()
+			continue
+		}
+		if !s.reserveStream() {
+			fmt.Println("remote-serve: " + s.name + " REACHED MAX STREAMS")
+			_ = conn.Close()
+			continue
+		}
+		go s.open(conn)
+	}
+}
+
+// open carries conn over a new stream, backend reserved its slot.
+func (s *serverConn) open(conn net.Conn) {
+	defer s.releaseStream()
+	header, err := json.Marshal(protocol.StreamHeader{
+		Type:   "tcp",
+		Local:  protocol.NewAddr(conn.LocalAddr()).Encode(),
+		Remote: protocol.NewAddr(conn.RemoteAddr()).Encode(),
+	})
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	stream, err := s.session.OpenStream(s.background, header)
+	if err != nil {
+		fmt.Println("remote-serve: NO CLIENT CONNECTED FOR NEW CONNECTION")
+		_ = conn.Close()
+		return
+	}
+	if s.options.ProxyProtocol {
+		if _, err = stream.Write(proxyHeader(conn.RemoteAddr(), conn.LocalAddr())); err != nil {
+			_ = stream.Close()
 			_ = conn.Close()
-		} else {
-			s.conns[msg.Id] = conn
-			go func() {
-				cache := make([]byte, 1024)
-				for {
-					n, err := conn.Read(cache)
-					if s.clientRequests != nil {
-						if err != nil {
-							if s.clientRequests.Send(context.Background(), protocol.NewMessage("close", protocol.MessageData{
-								Id:    msg.Id,
-								Close: true,
-							})) != nil {
-								s.Close()
-							} else {
-								s.sync.Lock()
-								delete(s.conns, msg.Data.Id)
-								s.sync.Unlock()
-							}
-							return
-						} else {
-							if s.clientRequests.Send(context.Background(), protocol.NewMessage("write", protocol.MessageData{
-								Id:       msg.Id,
-								Data:     cache[:n],
-								Deadline: time.Time{},
-								Close:    false,
-							})) != nil {
-								s.Close()
-								return
-							}
-						}
-					} else {
-						return
-					}
-				}
-			}()
+			return
 		}
 	}
+	start := time.Now()
+	read, err := s.pipe(stream, conn, s.startMirror(conn))
+	s.reportSource(conn.RemoteAddr(), read, err, time.Since(start))
+}
+
+func (s *serverConn) touch(conn net.Conn) {
+	if s.options.IdleTimeout > 0 {
+		_ = conn.SetReadDeadline(time.Now().Add(time.Duration(s.options.IdleTimeout)))
+	}
 }
 
-func (s *serverConn) clientBackend() {
+// copy moves src to dst until either fails, traffic in both directions
+// keeps the public connection from going idle. The bytes are offered to m
+// when it is set. It returns how much it read and the error src ended with.
+func (s *serverConn) copy(dst io.Writer, src io.Reader, conn net.Conn, toClient bool, m *mirror) (int64, error) {
+	cache := make([]byte, 32*1024)
+	var read int64
 	for {
-		for msg := range s.clientResponses.Receive() {
-			if conn, ok := s.conns[msg.Data.Id]; ok {
-				switch msg.Type {
-				case "close":
-					s.sync.Lock()
-					delete(s.conns, msg.Data.Id)
-					s.sync.Unlock()
-					_ = conn.Close()
-				case "write":
-					_, err := conn.Write(msg.Data.Data)
-					if err != nil {
-						err = s.clientRequests.Send(context.Background(), protocol.NewMessage("close", protocol.MessageData{
-							Id: msg.Data.Id,
-						}))
-						if err != nil {
-							s.Close()
-						} else {
-							s.sync.Lock()
-							delete(s.conns, msg.Data.Id)
-							s.sync.Unlock()
-							_ = conn.Close()
-						}
-					}
-				case "set_deadline":
-					err := conn.SetDeadline(msg.Data.Deadline)
-					if err != nil {
-						err = s.clientRequests.Send(context.Background(), protocol.NewMessage("close", protocol.MessageData{
-							Id: msg.Data.Id,
-						}))
-						if err != nil {
-							s.Close()
-						} else {
-							s.sync.Lock()
-							delete(s.conns, msg.Data.Id)
-							s.sync.Unlock()
-							_ = conn.Close()
-						}
-					}
-				case "set_read_deadline":
-					err := conn.SetReadDeadline(msg.Data.Deadline)
-					if err != nil {
-						err = s.clientRequests.Send(context.Background(), protocol.NewMessage("close", protocol.MessageData{
-							Id: msg.Data.Id,
-						}))
-						if err != nil {
-							s.Close()
-						} else {
-							s.sync.Lock()
-							delete(s.conns, msg.Data.Id)
-							s.sync.Unlock()
-							_ = conn.Close()
-						}
-					}
-				case "set_write_deadline":
-					err := conn.SetWriteDeadline(msg.Data.Deadline)
-					if err != nil {
-						err = s.clientRequests.Send(context.Background(), protocol.NewMessage("close", protocol.MessageData{
-							Id: msg.Data.Id,
-						}))
-						if err != nil {
-							s.Close()
-						} else {
-							s.sync.Lock()
-							delete(s.conns, msg.Data.Id)
-							s.sync.Unlock()
-							_ = conn.Close()
-						}
-					}
-				}
+		n, err := src.Read(cache)
+		if n > 0 {
+			read += int64(n)
+			s.touch(conn)
+			if !s.throttle(toClient, n) {
+				return read, nil
 			}
+			m.offer(cache[:n])
+			if _, err := dst.Write(cache[:n]); err != nil {
+				return read, nil
+			}
+		}
+		if err != nil {
+			return read, err
 		}
 	}
 }
 
+// pipe copies between stream and conn until either ends, it returns how many
+// bytes conn sent and why it stopped sending.
+func (s *serverConn) pipe(stream *protocol.Stream, conn net.Conn, m *mirror) (int64, error) {
+	s.touch(conn)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _ = s.copy(conn, stream, conn, false, nil)
+		_ = conn.Close()
+	}()
+	read, err := s.copy(stream, conn, conn, true, m)
+	m.finish()
+	_ = stream.Close()
+	_ = conn.Close()
+	<-done
+	return read, err
+}
+
+func (s *serverConn) expire(at time.Time) {
+	timer := time.NewTimer(time.Until(at))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		fmt.Println("remote-serve: " + s.name + " EXPIRED")
+		_ = s.Close()
+	case <-s.background.Done():
+	}
+}
+
 func (s *serverConn) Context() context.Context {
 	return s.background
 }
 
 func (s *serverConn) Close() error {
-	s.sync.Lock()
-	for _, v := range s.conns {
-		_ = v.Close()
+	_ = s.session.Close()
+	s.close()
+	if s.packets != nil {
+		return s.packets.Close()
 	}
-	if s.clientRequests != nil {
-		_ = s.clientRequests.Close()
-		_ = s.clientResponses.Close()
+	if s.listener != nil {
+		return s.listener.Close()
 	}
-	s.conns = map[string]net.Conn{}
-	s.sync.Unlock()
-	s.close()
-	return s.listener.Close()
+	return nil
+}
+
+// closeWithReason closes the tunnel and tells its client why.
+func (s *serverConn) closeWithReason(reason string) {
+	_ = s.session.CloseWithReason(reason)
+	_ = s.Close()
 }
 
 func (s *serverConn) String() string {
 	return s.name
 }
 
-func newServerConn(addr, name string, receiver protocol.Receiver, sender protocol.Sender) (*serverConn, error) {
-	listener, err := net.Listen("tcp", addr)
-	if err != nil {
-		return nil, err
-	}
+// newServerConn serves a tunnel on either a tcp listener or a udp socket, a
+// mirror tunnel has neither and only receives the streams of the tunnel bound
+// to bind.
+func newServerConn(bind string, listener net.Listener, packets net.PacketConn, identity *Identity, options protocol.TunnelOptions, server *Server, session *protocol.Session) *serverConn {
 	background, cancel := context.WithCancel(context.Background())
 	out := &serverConn{
-		listener:        listener,
-		name:            name + " -> " + addr,
-		conns:           make(map[string]net.Conn),
-		sync:            sync.RWMutex{},
-		clientRequests:  sender,
-		clientResponses: receiver,
-		background:      background,
-		close:           cancel,
+		bind:       bind,
+		listener:   listener,
+		packets:    packets,
+		identity:   identity,
+		options:    options,
+		server:     server,
+		session:    session,
+		bandwidth:  newBandwidthBuckets(_bandwidthFor(server.options.tunnelBandwidth, identity.Key)),
+		udp:        make(map[string]*udpSession),
+		ready:      make(chan struct{}),
+		background: background,
+		close:      cancel,
+	}
+	// the tunnel policy was validated when it was granted
+	tunnelSources, _ := newSourceFilter(SourcePolicy{Allow: options.AllowSources, Deny: options.DenySources})
+	for _, filter := range []*sourceFilter{server.sources, server.keySources[identity.Key], tunnelSources} {
+		if filter != nil {
+			out.sources = append(out.sources, filter)
+		}
+	}
+	if server.keyBandwidth != nil {
+		out.keyBandwidth = server.keyBandwidth.get(identity.Key)
+	}
+	if packets != nil {
+		out.name = identity.Key + " -> udp " + packets.LocalAddr().String()
+	} else if options.Mirror {
+		out.name = identity.Key + " -> mirror of " + bind
+	} else {
+		out.name = identity.Key + " -> " + listener.Addr().String()
+	}
+	go func() {
+		<-session.Done()
+		_ = out.Close()
+	}()
+	return out
+}
+
+// reserveStream takes one of the MaxStreams slots of the tunnel before a
+// stream is opened on it, releaseStream gives it back once the stream ended.
+func (s *serverConn) reserveStream() bool {
+	s.sync.Lock()
+	defer s.sync.Unlock()
+	return s._reserveStream()
+}
+
+func (s *serverConn) _reserveStream() bool {
+	if s.options.MaxStreams > 0 && s.streams >= s.options.MaxStreams {
+		return false
+	}
+	s.streams++
+	return true
+}
+
+func (s *serverConn) releaseStream() {
+	s.sync.Lock()
+	defer s.sync.Unlock()
+	s.streams--
+}
+
+// start serves the tunnel once the client got the proof of the handshake.
+func (s *serverConn) start() {
+	if s.packets != nil {
+		go s.packetBackend()
+	} else if !s.options.Mirror {
+		go s.backend()
+	}
+	go s.streamsBackend()
+	if !s.identity.Expires.IsZero() {
+		go s.expire(s.identity.Expires)
 	}
-	go out.backend()
-	go out.clientBackend()
-	return out, nil
+	close(s.ready)
 }
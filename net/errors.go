@@ -0,0 +1,72 @@
+package net
+
+import (
+	"errors"
+	"fmt"
+	"github.com/zbrumen/remote-serve/protocol"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrUnauthorized      = errors.New("unauthorized")
+	ErrRateLimited       = errors.New("too many failed attempts")
+	ErrBadRequest        = errors.New("bad tunnel request")
+	ErrProtocolVersion   = errors.New("protocol version mismatch")
+	ErrAddressInUse      = errors.New("address in use")
+	ErrForbiddenAddress  = errors.New("forbidden address")
+	ErrServerUnavailable = errors.New("server unavailable")
+	ErrServerIdentity    = errors.New("server failed to prove its identity")
+	ErrQuotaExceeded     = errors.New("quota exceeded")
+)
+
+var tunnelErrors = map[string]error{
+	protocol.ErrorUnauthorized:     ErrUnauthorized,
+	protocol.ErrorRateLimited:      ErrRateLimited,
+	protocol.ErrorBadRequest:       ErrBadRequest,
+	protocol.ErrorProtocolVersion:  ErrProtocolVersion,
+	protocol.ErrorAddressInUse:     ErrAddressInUse,
+	protocol.ErrorForbiddenAddress: ErrForbiddenAddress,
+	protocol.ErrorUnavailable:      ErrServerUnavailable,
+	protocol.ErrorQuotaExceeded:    ErrQuotaExceeded,
+}
+
+// TunnelError is a refusal sent by the server. It matches the sentinel error
+// of its code with errors.Is, Fields holds per field errors of the request.
+// Refusals come before the server proves itself and are not signed, anyone
+// on the path can forge them, so treat them as hints and never as proof the
+// server refused.
+type TunnelError struct {
+	Code    string
+	Message string
+	Fields  map[string]string
+}
+
+func (e *TunnelError) Error() string {
+	out := "remote-serve: " + e.Code
+	if e.Message != "" {
+		out += ": " + e.Message
+	}
+	if len(e.Fields) > 0 {
+		var fields []string
+		for field, msg := range e.Fields {
+			fields = append(fields, field+": "+msg)
+		}
+		sort.Strings(fields)
+		out += fmt.Sprintf(" (%s)", strings.Join(fields, ", "))
+	}
+	return out
+}
+
+func (e *TunnelError) Unwrap() error {
+	return tunnelErrors[e.Code]
+}
+
+// Temporary reports whether retrying the same request later may succeed.
+func (e *TunnelError) Temporary() bool {
+	switch e.Code {
+	case protocol.ErrorRateLimited, protocol.ErrorAddressInUse, protocol.ErrorUnavailable, protocol.ErrorQuotaExceeded:
+		return true
+	}
+	return false
+}
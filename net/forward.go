@@ -0,0 +1,395 @@
+package net
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/zbrumen/remote-serve/protocol"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	forwardDialTimeout    = time.Second * 10
+	maxStreamResponseSize = 4096
+)
+
+func writeStreamResponse(stream *protocol.Stream, resp protocol.StreamResponse) error {
+	raw, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	_, err = stream.Write(append(raw, '\n'))
+	return err
+}
+
+// readStreamResponse reads the response line of a "dial" stream, ctx
+// interrupts the read.
+func readStreamResponse(ctx context.Context, stream *protocol.Stream) (protocol.StreamResponse, error) {
+	var resp protocol.StreamResponse
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			_ = stream.SetReadDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+	var line []byte
+	cache := make([]byte, 1)
+	var err error
+	for len(line) <= maxStreamResponseSize {
+		if _, err = stream.Read(cache); err != nil || cache[0] == '\n' {
+			break
+		}
+		line = append(line, cache[0])
+	}
+	close(stop)
+	<-stopped
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err == nil && len(line) > maxStreamResponseSize {
+		err = fmt.Errorf("stream response exceeds %d bytes", maxStreamResponseSize)
+	}
+	if err != nil {
+		return resp, err
+	}
+	return resp, json.Unmarshal(line, &resp)
+}
+
+// join copies between both connections until either side is done.
+func join(a, b net.Conn) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _ = io.Copy(a, b)
+		_ = a.Close()
+	}()
+	_, _ = io.Copy(b, a)
+	_ = b.Close()
+	_ = a.Close()
+	<-done
+}
+
+// acceptDial answers a "dial" stream, it connects to the target when
+// allowed returns nil for it and returns the connection to pipe the stream
+// to, or nil when the stream was refused. Unix targets are passed to allowed
+// as "unix:/path".
+func acceptDial(ctx context.Context, stream *protocol.Stream, header protocol.StreamHeader, allowed func(target string) error) net.Conn {
+	network, target := header.Network, header.Target
+	switch network {
+	case "":
+		network = "tcp"
+	case "tcp", "tcp4", "tcp6":
+	case "unix":
+		target = "unix:" + target
+	default:
+		refuseDial(stream, protocol.ErrorBadRequest, "unsupported network "+network)
+		return nil
+	}
+	if err := allowed(target); err != nil {
+		refuseDial(stream, protocol.ErrorForbiddenAddress, err.Error())
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, forwardDialTimeout)
+	conn, err := (&net.Dialer{}).DialContext(ctx, network, header.Target)
+	cancel()
+	if err != nil {
+		refuseDial(stream, protocol.ErrorUnavailable, err.Error())
+		return nil
+	}
+	err = writeStreamResponse(stream, protocol.StreamResponse{
+		Local:  protocol.NewAddr(conn.LocalAddr()).Encode(),
+		Remote: protocol.NewAddr(conn.RemoteAddr()).Encode(),
+	})
+	if err != nil {
+		_ = stream.Close()
+		_ = conn.Close()
+		return nil
+	}
+	return conn
+}
+
+func refuseDial(stream *protocol.Stream, code, message string) {
+	_ = writeStreamResponse(stream, protocol.StreamResponse{Error: code, Message: message})
+	_ = stream.Close()
+}
+
+// dialStream opens a "dial" stream with header.
+func dialStream(ctx context.Context, session *protocol.Session, header protocol.StreamHeader) (net.Conn, error) {
+	header.Type = "dial"
+	raw, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := session.OpenStream(ctx, raw)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := readStreamResponse(ctx, stream)
+	if err == nil && resp.Error != "" {
+		err = &TunnelError{Code: resp.Error, Message: resp.Message}
+	}
+	if err != nil {
+		_ = stream.Close()
+		return nil, err
+	}
+	_ = stream.SetReadDeadline(time.Time{})
+	local, err := protocol.DecodeAddr(resp.Local)
+	if err != nil {
+		_ = stream.Close()
+		return nil, err
+	}
+	remote, err := protocol.DecodeAddr(resp.Remote)
+	if err != nil {
+		_ = stream.Close()
+		return nil, err
+	}
+	return &tunnelConn{Stream: stream, local: local, remote: remote}, nil
+}
+
+func (s *serverConn) streamsBackend() {
+	for {
+		stream, err := s.session.AcceptStream(s.background)
+		if err != nil {
+			return
+		}
+		if !s.reserveStream() {
+			fmt.Println("remote-serve: " + s.name + " REACHED MAX STREAMS")
+			_ = stream.CloseWithReason("too many streams")
+			continue
+		}
+		go s.forward(stream)
+	}
+}
+
+func (s *serverConn) allowDial(target string) error {
+	if s.identity.CanDial(target) || _dialAllowed(s.server.options.dials[s.identity.Key], target) {
+		return nil
+	}
+	fmt.Println("remote-serve: " + s.name + " MAY NOT DIAL " + target)
+	return fmt.Errorf("%s may not dial %s", s.identity.Key, target)
+}
+
+// forward serves a stream the client opened, streamsBackend reserved its
+// slot.
+func (s *serverConn) forward(stream *protocol.Stream) {
+	defer s.releaseStream()
+	var header protocol.StreamHeader
+	if err := json.Unmarshal(stream.Header(), &header); err != nil || header.Type != "dial" {
+		_ = stream.CloseWithReason("unsupported stream")
+		return
+	}
+	var conn net.Conn
+	if header.Peer != "" {
+		conn = s.relay(stream, header)
+	} else {
+		conn = acceptDial(s.background, stream, header, s.allowDial)
+	}
+	if conn != nil {
+		_, _ = s.pipe(stream, conn, nil)
+	}
+}
+
+func _peerAllowed(acl map[string]map[string][]string, from, peer, target string) bool {
+	return _dialAllowed(acl[from][peer], target) || _dialAllowed(acl[from]["*"], target)
+}
+
+// relay connects a "dial" stream to the client connected as header.Peer.
+func (s *serverConn) relay(stream *protocol.Stream, header protocol.StreamHeader) net.Conn {
+	target := header.Target
+	if header.Network == "unix" {
+		target = "unix:" + target
+	}
+	if !_peerAllowed(s.server.options.peers, s.identity.Key, header.Peer, target) {
+		fmt.Println("remote-serve: " + s.name + " MAY NOT REACH " + target + " ON " + header.Peer)
+		refuseDial(stream, protocol.ErrorForbiddenAddress, fmt.Sprintf("%s may not reach %s on %s", s.identity.Key, target, header.Peer))
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(s.background, forwardDialTimeout)
+	conn, err := s.server.dialTunnel(ctx, header.Peer, header.Network, header.Target)
+	cancel()
+	if err != nil {
+		var tunnelErr *TunnelError
+		if errors.As(err, &tunnelErr) {
+			refuseDial(stream, tunnelErr.Code, tunnelErr.Message)
+		} else {
+			refuseDial(stream, protocol.ErrorUnavailable, err.Error())
+		}
+		return nil
+	}
+	err = writeStreamResponse(stream, protocol.StreamResponse{
+		Local:  protocol.NewAddr(conn.LocalAddr()).Encode(),
+		Remote: protocol.NewAddr(conn.RemoteAddr()).Encode(),
+	})
+	if err != nil {
+		_ = stream.Close()
+		_ = conn.Close()
+		return nil
+	}
+	return conn
+}
+
+func (c *Client) Dial(network, addr string) (net.Conn, error) {
+	return c.DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to addr from the network of the server, like ssh -L.
+// The server only dials destinations allowed for the key of the client.
+func (c *Client) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return dialStream(ctx, c.session, protocol.StreamHeader{Network: network, Target: addr})
+}
+
+func (c *Client) DialPeer(peer, addr string) (net.Conn, error) {
+	return c.DialPeerContext(context.Background(), peer, addr)
+}
+
+// DialPeerContext connects to addr, a host:port or "unix:/path", from the
+// network of the client connected to the same server with the key peer. The
+// server relays the stream when its peer ACL allows it, see WithPeerACL, and
+// the peer dials addr when its WithClientDialAllowlist does.
+func (c *Client) DialPeerContext(ctx context.Context, peer, addr string) (net.Conn, error) {
+	network, target := _splitNetwork(addr)
+	return dialStream(ctx, c.session, protocol.StreamHeader{Network: network, Target: target, Peer: peer})
+}
+
+func (c *Client) allowDial(target string) error {
+	if _dialAllowed(c.options.dials, target) {
+		return nil
+	}
+	fmt.Println("remote-server-client: SERVER MAY NOT DIAL " + target)
+	return fmt.Errorf("client does not allow dialing %s", target)
+}
+
+// DialTunnel connects to targetAddr, a host:port or "unix:/path", from the
+// network of a client connected with key, without a public port. The client
+// only dials destinations it allows with WithClientDialAllowlist.
+func (s *Server) DialTunnel(ctx context.Context, key, targetAddr string) (net.Conn, error) {
+	network, target := _splitNetwork(targetAddr)
+	return s.dialTunnel(ctx, key, network, target)
+}
+
+func (s *Server) dialTunnel(ctx context.Context, key, network, target string) (net.Conn, error) {
+	var tunnels []*serverConn
+	s.sync.RLock()
+	for _, conn := range s.conns {
+		// shadows only take mirrored traffic
+		if conn.identity.Key == key && !conn.options.Mirror {
+			tunnels = append(tunnels, conn)
+		}
+	}
+	s.sync.RUnlock()
+	// every client of the key allows its own destinations, try them in a
+	// stable order until one dials target
+	sort.Slice(tunnels, func(i, j int) bool {
+		return tunnels[i].name < tunnels[j].name
+	})
+	var err error = &TunnelError{Code: protocol.ErrorUnavailable, Message: key + " is not connected"}
+	for i, tunnel := range tunnels {
+		conn, dialErr := tunnel.dial(ctx, network, target)
+		if dialErr == nil {
+			return conn, nil
+		}
+		if i == 0 {
+			err = dialErr
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, err
+}
+
+// dial opens a dial stream to target once the tunnel started, the stream
+// holds one of its slots until closed.
+func (s *serverConn) dial(ctx context.Context, network, target string) (net.Conn, error) {
+	select {
+	case <-s.ready:
+	case <-s.Context().Done():
+		return nil, &TunnelError{Code: protocol.ErrorUnavailable, Message: s.identity.Key + " is not connected"}
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if !s.reserveStream() {
+		return nil, &TunnelError{Code: protocol.ErrorUnavailable, Message: s.identity.Key + " has too many streams"}
+	}
+	conn, err := dialStream(ctx, s.session, protocol.StreamHeader{Network: network, Target: target})
+	if err != nil {
+		s.releaseStream()
+		return nil, err
+	}
+	return &reservedConn{Conn: conn, release: s.releaseStream}, nil
+}
+
+// reservedConn gives the stream slot of its tunnel back once closed.
+type reservedConn struct {
+	net.Conn
+
+	release func()
+	once    sync.Once
+}
+
+func (c *reservedConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+// ListenForward listens on localAddr and connects every accepted connection
+// to target through the server, see DialContext. Closing the listener stops
+// forwarding new connections.
+func (c *Client) ListenForward(network, localAddr, target string) (net.Listener, error) {
+	listener, err := net.Listen(network, localAddr)
+	if err != nil {
+		return nil, err
+	}
+	go c.forwardBackend(listener, target)
+	return listener, nil
+}
+
+func (c *Client) forwardBackend(listener net.Listener, target string) {
+	go func() {
+		<-c.session.Done()
+		_ = listener.Close()
+	}()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			remote, err := c.Dial("tcp", target)
+			if err != nil {
+				fmt.Println("remote-server-client: FORWARD ERROR: " + err.Error())
+				_ = conn.Close()
+				return
+			}
+			join(conn, remote)
+		}()
+	}
+}
+
+// Forward connects every tunneled connection to addr on the network of the
+// client, e.g. the "unix" socket of a local daemon, until the client closes.
+func (c *Client) Forward(network, addr string) error {
+	for {
+		conn, err := c.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			local, err := net.Dial(network, addr)
+			if err != nil {
+				fmt.Println("remote-server-client: FORWARD ERROR: " + err.Error())
+				_ = conn.Close()
+				return
+			}
+			join(conn, local)
+		}()
+	}
+}
@@ -0,0 +1,207 @@
+package net
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+func echoServer(t *testing.T) net.Listener {
+	t.Helper()
+	return echoServerOn(t, "tcp", "127.0.0.1:0")
+}
+
+func echoServerOn(t *testing.T, network, addr string) net.Listener {
+	t.Helper()
+	listener, err := net.Listen(network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener
+}
+
+func expectEcho(t *testing.T, conn net.Conn) {
+	t.Helper()
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	cache := make([]byte, 4)
+	if _, err := io.ReadFull(conn, cache); err != nil {
+		t.Fatal(err)
+	}
+	if string(cache) != "ping" {
+		t.Fatal("unexpected echo " + string(cache))
+	}
+}
+
+func TestDial(t *testing.T) {
+	target := echoServer(t)
+	srvr, err := NewServer("127.0.0.1:0", StaticAuthenticator{"username": "password", "other": "password"}, WithDialAllowlist(map[string][]string{
+		"username": {"127.0.0.1:*"},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srvr.Close()
+	client, err := NewClient("tcp", srvr.Addr().String(), "username", "password", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := client.Dial("tcp", target.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.RemoteAddr().String() != target.Addr().String() {
+		t.Fatal("unexpected remote address " + conn.RemoteAddr().String())
+	}
+	expectEcho(t, conn)
+
+	other, err := NewClient("tcp", srvr.Addr().String(), "other", "password", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if _, err = other.Dial("tcp", target.Addr().String()); !errors.Is(err, ErrForbiddenAddress) {
+		t.Fatal("key without an allowlist could dial", err)
+	}
+}
+
+func TestListenForward(t *testing.T) {
+	target := echoServer(t)
+	srvr, err := NewServer("127.0.0.1:0", StaticAuthenticator{"username": "password"}, WithDialAllowlist(map[string][]string{
+		"username": {target.Addr().String()},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srvr.Close()
+	client, err := NewClient("tcp", srvr.Addr().String(), "username", "password", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	listener, err := client.ListenForward("tcp", "127.0.0.1:0", target.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	expectEcho(t, conn)
+}
+
+func TestCanDial(t *testing.T) {
+	identity := &Identity{Dials: []string{"db.internal:5432", "10.0.0.0/8:*", "*:443"}}
+	for addr, allowed := range map[string]bool{
+		"db.internal:5432":  true,
+		"DB.internal:5432":  true,
+		"db.internal:5433":  false,
+		"10.1.2.3:22":       true,
+		"11.1.2.3:22":       false,
+		"example.com:443":   true,
+		"example.com:80":    false,
+		"no-port-specified": false,
+	} {
+		if identity.CanDial(addr) != allowed {
+			t.Error("unexpected CanDial result for", addr)
+		}
+	}
+	if (&Identity{}).CanDial("127.0.0.1:80") {
+		t.Fatal("empty Dials allowed a destination")
+	}
+	if (&Identity{Dials: []string{"*"}}).CanDial("unix:/var/run/docker.sock") {
+		t.Fatal("wildcard allowed a unix socket")
+	}
+}
+
+func TestDialTunnel(t *testing.T) {
+	target, forbidden := echoServer(t), echoServer(t)
+	srvr, err := NewServer("127.0.0.1:0", StaticAuthenticator{"device": "password"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srvr.Close()
+	client, err := NewClient("tcp", srvr.Addr().String(), "device", "password", "127.0.0.1:0", WithClientDialAllowlist(target.Addr().String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	// a second client of the key that allows nothing must not fail the dial
+	other, err := NewClient("tcp", srvr.Addr().String(), "device", "password", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	for i := 0; i < 10; i++ {
+		conn, err := srvr.DialTunnel(context.Background(), "device", target.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectEcho(t, conn)
+		_ = conn.Close()
+	}
+	if _, err = srvr.DialTunnel(context.Background(), "device", forbidden.Addr().String()); !errors.Is(err, ErrForbiddenAddress) {
+		t.Fatal("client dialed a destination outside of its allowlist", err)
+	}
+	if _, err = srvr.DialTunnel(context.Background(), "unknown", target.Addr().String()); !errors.Is(err, ErrServerUnavailable) {
+		t.Fatal("dialed through a key that is not connected", err)
+	}
+}
+
+func TestDialPeer(t *testing.T) {
+	target := echoServer(t)
+	srvr, err := NewServer("127.0.0.1:0", StaticAuthenticator{"agent-a": "a", "agent-b": "b"}, WithPeerACL(map[string]map[string][]string{
+		"agent-a": {"agent-b": {"127.0.0.1:*"}, "*": {"10.0.0.1:22"}},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srvr.Close()
+	a, err := NewClient("tcp", srvr.Addr().String(), "agent-a", "a", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := NewClient("tcp", srvr.Addr().String(), "agent-b", "b", "127.0.0.1:0", WithClientDialAllowlist(target.Addr().String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	conn, err := a.DialPeer("agent-b", target.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEcho(t, conn)
+	_ = conn.Close()
+	if _, err = b.DialPeer("agent-a", target.Addr().String()); !errors.Is(err, ErrForbiddenAddress) {
+		t.Fatal("peer without an ACL entry was relayed", err)
+	}
+	if _, err = a.DialPeer("agent-b", "127.0.0.1:1"); !errors.Is(err, ErrForbiddenAddress) {
+		t.Fatal("peer dialed a target outside of its allowlist", err)
+	}
+	if _, err = a.DialPeer("agent-c", "10.0.0.1:22"); !errors.Is(err, ErrServerUnavailable) {
+		t.Fatal("relayed to a peer that is not connected", err)
+	}
+}
@@ -0,0 +1,91 @@
+package net
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// AuthorizedKeys maps key names to the Ed25519 public keys allowed to sign
+// server challenges in their name.
+type AuthorizedKeys map[string]ed25519.PublicKey
+
+func (a AuthorizedKeys) Authenticate(key, challenge, response string) (*Identity, error) {
+	public, ok := a[key]
+	signature, err := base64.StdEncoding.DecodeString(response)
+	if !ok || err != nil || !ed25519.Verify(public, []byte(challenge), signature) {
+		return nil, fmt.Errorf("unauthorized")
+	}
+	return &Identity{Key: key}, nil
+}
+
+func ParsePublicKey(str string) (ed25519.PublicKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(str))
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("public key must be %d bytes", ed25519.PublicKeySize)
+	}
+	return raw, nil
+}
+
+func ParsePrivateKey(str string) (ed25519.PrivateKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(str))
+	if err != nil {
+		return nil, err
+	}
+	switch len(raw) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(raw), nil
+	case ed25519.PrivateKeySize:
+		return raw, nil
+	default:
+		return nil, fmt.Errorf("private key must be a %d byte seed", ed25519.SeedSize)
+	}
+}
+
+func EncodePublicKey(key ed25519.PublicKey) string {
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func EncodePrivateKey(key ed25519.PrivateKey) string {
+	return base64.StdEncoding.EncodeToString(key.Seed())
+}
+
+func LoadPrivateKey(path string) (ed25519.PrivateKey, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePrivateKey(string(raw))
+}
+
+// LoadAuthorizedKeys reads "key base64-public-key" lines from a file.
+func LoadAuthorizedKeys(path string) (AuthorizedKeys, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	out := make(AuthorizedKeys)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected key and public key", path, line)
+		}
+		public, err := ParsePublicKey(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		out[fields[0]] = public
+	}
+	return out, scanner.Err()
+}
@@ -0,0 +1,136 @@
+package net
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// AuthLimits controls how the server slows down and bans sources and keys
+// that keep failing authentication. Every failure doubles the time the next
+// attempt has to wait, starting at BaseDelay and capped at MaxDelay. After
+// BanAfter consecutive failures the source or key is banned for BanFor.
+type AuthLimits struct {
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	BanAfter  int
+	BanFor    time.Duration
+}
+
+var DefaultAuthLimits = AuthLimits{
+	BaseDelay: time.Second,
+	MaxDelay:  time.Minute,
+	BanAfter:  10,
+	BanFor:    time.Minute * 15,
+}
+
+type failureCounter struct {
+	failures    int
+	retryAfter  time.Time
+	bannedUntil time.Time
+	last        time.Time
+}
+
+type authLimiter struct {
+	limits AuthLimits
+
+	sources map[string]*failureCounter
+	keys    map[string]*failureCounter
+	sync    sync.Mutex
+}
+
+func (l *authLimiter) _check(counters map[string]*failureCounter, name string, now time.Time) error {
+	counter, ok := counters[name]
+	if !ok {
+		return nil
+	}
+	if now.Before(counter.bannedUntil) {
+		return fmt.Errorf("%s is banned until %s", name, counter.bannedUntil.Format(time.RFC3339))
+	}
+	if now.Before(counter.retryAfter) {
+		return fmt.Errorf("%s must wait until %s", name, counter.retryAfter.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func (l *authLimiter) _fail(counters map[string]*failureCounter, name string, now time.Time) {
+	counter, ok := counters[name]
+	if !ok || now.Sub(counter.last) > l.limits.BanFor {
+		counter = &failureCounter{}
+		counters[name] = counter
+	}
+	counter.failures++
+	counter.last = now
+	delay := l.limits.BaseDelay << (counter.failures - 1)
+	if delay > l.limits.MaxDelay || delay <= 0 {
+		delay = l.limits.MaxDelay
+	}
+	counter.retryAfter = now.Add(delay)
+	if l.limits.BanAfter > 0 && counter.failures >= l.limits.BanAfter {
+		counter.bannedUntil = now.Add(l.limits.BanFor)
+		counter.failures = 0
+	}
+}
+
+func (l *authLimiter) checkSource(source string) error {
+	if l == nil {
+		return nil
+	}
+	l.sync.Lock()
+	defer l.sync.Unlock()
+	return l._check(l.sources, source, time.Now())
+}
+
+func (l *authLimiter) checkKey(key string) error {
+	if l == nil {
+		return nil
+	}
+	l.sync.Lock()
+	defer l.sync.Unlock()
+	return l._check(l.keys, key, time.Now())
+}
+
+func (l *authLimiter) fail(source, key string) {
+	if l == nil {
+		return
+	}
+	l.sync.Lock()
+	defer l.sync.Unlock()
+	now := time.Now()
+	l._fail(l.sources, source, now)
+	if key != "" {
+		l._fail(l.keys, key, now)
+	}
+}
+
+// succeed forgets the failures of key. The failures of the source stay, one
+// valid key must not let a source keep guessing others.
+func (l *authLimiter) succeed(key string) {
+	if l == nil {
+		return
+	}
+	l.sync.Lock()
+	defer l.sync.Unlock()
+	delete(l.keys, key)
+}
+
+func (l *authLimiter) cleanup() {
+	l.sync.Lock()
+	defer l.sync.Unlock()
+	now := time.Now()
+	for _, counters := range []map[string]*failureCounter{l.sources, l.keys} {
+		for name, counter := range counters {
+			if now.After(counter.bannedUntil) && now.Sub(counter.last) > l.limits.BanFor {
+				delete(counters, name)
+			}
+		}
+	}
+}
+
+func newAuthLimiter(limits AuthLimits) *authLimiter {
+	return &authLimiter{
+		limits:  limits,
+		sources: make(map[string]*failureCounter),
+		keys:    make(map[string]*failureCounter),
+	}
+}
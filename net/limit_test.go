@@ -0,0 +1,39 @@
+package net
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAuthLimiter(t *testing.T) {
+	limiter := newAuthLimiter(AuthLimits{
+		BaseDelay: time.Millisecond * 20,
+		MaxDelay:  time.Millisecond * 40,
+		BanAfter:  3,
+		BanFor:    time.Hour,
+	})
+	limiter.fail("10.0.0.1", "username")
+	if limiter.checkSource("10.0.0.1") == nil || limiter.checkKey("username") == nil {
+		t.Fatal("failed attempt was not delayed")
+	}
+	if limiter.checkSource("10.0.0.2") != nil {
+		t.Fatal("unrelated source was delayed")
+	}
+	time.Sleep(time.Millisecond * 30)
+	if limiter.checkSource("10.0.0.1") != nil {
+		t.Fatal("delay did not expire")
+	}
+	limiter.fail("10.0.0.1", "username")
+	limiter.fail("10.0.0.1", "username")
+	time.Sleep(time.Millisecond * 50)
+	if limiter.checkSource("10.0.0.1") == nil || limiter.checkKey("username") == nil {
+		t.Fatal("source was not banned")
+	}
+	limiter.succeed("username")
+	if limiter.checkKey("username") != nil {
+		t.Fatal("successful login did not reset the key")
+	}
+	if limiter.checkSource("10.0.0.1") == nil {
+		t.Fatal("successful login reset the ban of the source")
+	}
+}
@@ -0,0 +1,155 @@
+package net
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/zbrumen/remote-serve/protocol"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+)
+
+const mirrorQueueSize = 64
+
+// mirror carries a copy of the bytes a public connection sends to a shadow
+// client. It is dropped instead of slowing down the primary stream once the
+// shadow falls behind.
+type mirror struct {
+	queue chan []byte
+	done  chan struct{}
+	once  sync.Once
+}
+
+func (m *mirror) offer(b []byte) {
+	if m == nil {
+		return
+	}
+	select {
+	case <-m.done:
+		return
+	default:
+	}
+	select {
+	case m.queue <- append([]byte(nil), b...):
+	default:
+		m.stop()
+	}
+}
+
+// finish tells the shadow the public connection sent everything.
+func (m *mirror) finish() {
+	if m != nil {
+		close(m.queue)
+	}
+}
+
+func (m *mirror) stop() {
+	m.once.Do(func() {
+		close(m.done)
+	})
+}
+
+func (s *Server) mirrorOf(bind string) *serverConn {
+	s.sync.RLock()
+	defer s.sync.RUnlock()
+	return s.conns["mirror://"+bind]
+}
+
+// mirrored returns the tcp tunnel of key listening on bind, the tunnel a
+// shadow of key requesting bind mirrors.
+func (s *Server) mirrored(key, bind string) *serverConn {
+	s.sync.RLock()
+	defer s.sync.RUnlock()
+	for _, conn := range s.conns {
+		if conn.listener != nil && conn.identity.Key == key && _sameBind(bind, conn.listener.Addr()) {
+			return conn
+		}
+	}
+	return nil
+}
+
+// _sameBind tells whether a listener asked for bind listens on bound.
+func _sameBind(bind string, bound net.Addr) bool {
+	if bound.Network() == "unix" {
+		return bind == "unix:"+bound.String()
+	}
+	addr, ok := bound.(*net.TCPAddr)
+	requested, err := net.ResolveTCPAddr("tcp", bind)
+	if !ok || err != nil || requested.Port != addr.Port {
+		return false
+	}
+	if requested.IP == nil || requested.IP.IsUnspecified() {
+		return addr.IP.IsUnspecified()
+	}
+	return requested.IP.Equal(addr.IP)
+}
+
+// startMirror samples conn for the shadow registered on the bind of the
+// tunnel, it returns nil when conn is not mirrored.
+func (s *serverConn) startMirror(conn net.Conn) *mirror {
+	shadow := s.server.mirrorOf(s.bind)
+	// a later tunnel of another key on the bind is not mirrored
+	if shadow == nil || shadow.identity.Key != s.identity.Key || rand.Float64() >= shadow.options.MirrorRate {
+		return nil
+	}
+	select {
+	case <-shadow.ready:
+	default:
+		return nil
+	}
+	if !shadow.reserveStream() {
+		return nil
+	}
+	m := &mirror{
+		queue: make(chan []byte, mirrorQueueSize),
+		done:  make(chan struct{}),
+	}
+	go shadow.shadow(m, conn)
+	return m
+}
+
+// shadow writes the mirrored bytes of conn to a new stream and discards
+// whatever the shadow client answers.
+func (s *serverConn) shadow(m *mirror, conn net.Conn) {
+	defer s.releaseStream()
+	defer m.stop()
+	header, err := json.Marshal(protocol.StreamHeader{
+		Type:   "tcp",
+		Local:  protocol.NewAddr(conn.LocalAddr()).Encode(),
+		Remote: protocol.NewAddr(conn.RemoteAddr()).Encode(),
+	})
+	if err != nil {
+		return
+	}
+	stream, err := s.session.OpenStream(s.background, header)
+	if err != nil {
+		fmt.Println("remote-serve: " + s.name + " CANNOT OPEN MIRROR STREAM")
+		return
+	}
+	go func() {
+		<-m.done
+		_ = stream.Close()
+	}()
+	go func() {
+		_, _ = io.Copy(io.Discard, stream)
+	}()
+	if s.options.ProxyProtocol {
+		if _, err = stream.Write(proxyHeader(conn.RemoteAddr(), conn.LocalAddr())); err != nil {
+			return
+		}
+	}
+	for {
+		select {
+		case chunk, ok := <-m.queue:
+			if !ok {
+				return
+			}
+			if _, err = stream.Write(chunk); err != nil {
+				return
+			}
+		case <-m.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package net
+
+import (
+	"errors"
+	"github.com/zbrumen/remote-serve/protocol"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMirror(t *testing.T) {
+	srvr, err := NewServer("127.0.0.1:0", StaticAuthenticator{"username": "password", "other": "password"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srvr.Close()
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bind := free.Addr().String()
+	_ = free.Close()
+
+	primary, err := NewClient("tcp", srvr.Addr().String(), "username", "password", bind)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primary.Close()
+	target := echoServer(t)
+	go func() {
+		_ = primary.Forward("tcp", target.Addr().String())
+	}()
+	if _, err = NewClient("tcp", srvr.Addr().String(), "other", "password", bind, WithTunnelOptions(protocol.TunnelOptions{
+		Mirror: true,
+	})); !errors.Is(err, ErrForbiddenAddress) {
+		t.Fatal("tunnel of another key was mirrored", err)
+	}
+	shadow, err := NewClient("tcp", srvr.Addr().String(), "username", "password", bind, WithTunnelOptions(protocol.TunnelOptions{
+		Mirror: true,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer shadow.Close()
+	if shadow.Tunnel().Bind != bind {
+		t.Fatal("unexpected mirror bind " + shadow.Tunnel().Bind)
+	}
+	if shadow.Tunnel().Granted.MirrorRate != 1 {
+		t.Fatal("mirror rate did not default to 1")
+	}
+	mirrored := make(chan string, 1)
+	go func() {
+		conn, err := shadow.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// the answers of the shadow never reach the public connection
+		_, _ = conn.Write([]byte("pong"))
+		cache := make([]byte, 4)
+		if _, err = io.ReadFull(conn, cache); err == nil {
+			mirrored <- string(cache)
+		}
+	}()
+
+	public, err := net.Dial("tcp", bind)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer public.Close()
+	expectEcho(t, public)
+	select {
+	case msg := <-mirrored:
+		if msg != "ping" {
+			t.Fatal("unexpected mirrored bytes " + msg)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("stream was not mirrored")
+	}
+
+	_, err = NewClient("tcp", srvr.Addr().String(), "username", "password", "127.0.0.1:0", WithTunnelOptions(protocol.TunnelOptions{
+		Protocol: "udp",
+		Mirror:   true,
+	}))
+	if err == nil {
+		t.Fatal("udp tunnel was mirrored")
+	}
+	_, err = NewClient("tcp", srvr.Addr().String(), "username", "password", bind, WithTunnelOptions(protocol.TunnelOptions{
+		Mirror:     true,
+		MirrorRate: 2,
+	}))
+	if err == nil {
+		t.Fatal("mirror rate above 1 was granted")
+	}
+
+	// shadows find ephemeral tunnels by the address they were bound to
+	ephemeral, err := NewClient("tcp", srvr.Addr().String(), "username", "password", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ephemeral.Close()
+	ephemeralShadow, err := NewClient("tcp", srvr.Addr().String(), "username", "password", ephemeral.Tunnel().Bind, WithTunnelOptions(protocol.TunnelOptions{
+		Mirror: true,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = ephemeralShadow.Close()
+}
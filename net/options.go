@@ -0,0 +1,333 @@
+package net
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"github.com/zbrumen/remote-serve/protocol"
+	"net"
+	"path/filepath"
+	"time"
+)
+
+type serverOptions struct {
+	keys       AuthorizedKeys
+	hostKey    ed25519.PrivateKey
+	authLimits AuthLimits
+	tokens     *TokenAuthenticator
+
+	requireEncryption bool
+	tlsConfig         *tls.Config
+
+	handshakeTimeout     time.Duration
+	maxPendingHandshakes int
+	maxPendingPerSource  int
+	maxFrameSize         int
+	dials                map[string][]string
+	peers                map[string]map[string][]string
+	unixBindDir          string
+	tunnelBandwidth      map[string]Bandwidth
+	keyBandwidth         map[string]Bandwidth
+	quotas               map[string]Quota
+	quotaFile            string
+	maxStreams           int
+	sources              SourcePolicy
+	keySources           map[string]SourcePolicy
+	sourceLimits         SourceLimits
+
+	limiter *authLimiter
+}
+
+type ServerOption func(*serverOptions)
+
+// WithAuthorizedKeys enables Ed25519 client authentication next to the
+// shared secret Authenticator. Ed25519 clients are refused until the server
+// has a WithHostKey to prove itself with.
+func WithAuthorizedKeys(keys AuthorizedKeys) ServerOption {
+	return func(o *serverOptions) {
+		o.keys = keys
+	}
+}
+
+// WithHostKey lets the server prove itself to Ed25519 clients.
+func WithHostKey(key ed25519.PrivateKey) ServerOption {
+	return func(o *serverOptions) {
+		o.hostKey = key
+	}
+}
+
+// WithAuthLimits replaces DefaultAuthLimits. A zero AuthLimits disables
+// the failure tracking.
+func WithAuthLimits(limits AuthLimits) ServerOption {
+	return func(o *serverOptions) {
+		o.authLimits = limits
+	}
+}
+
+// WithTokenSecret accepts tokens minted by NewToken with the same secret.
+func WithTokenSecret(secret []byte) ServerOption {
+	return func(o *serverOptions) {
+		o.tokens = NewTokenAuthenticator(secret)
+	}
+}
+
+// WithRequireEncryption rejects clients that do not encrypt the control
+// connection with the session key.
+func WithRequireEncryption() ServerOption {
+	return func(o *serverOptions) {
+		o.requireEncryption = true
+	}
+}
+
+// WithTLSConfig serves the control port over TLS.
+func WithTLSConfig(config *tls.Config) ServerOption {
+	return func(o *serverOptions) {
+		o.tlsConfig = config
+	}
+}
+
+// WithHandshakeTimeout bounds how long a client may take to authenticate.
+func WithHandshakeTimeout(timeout time.Duration) ServerOption {
+	return func(o *serverOptions) {
+		o.handshakeTimeout = timeout
+	}
+}
+
+// WithMaxPendingHandshakes limits how many clients may be authenticating at
+// the same time, further connections are dropped. 0 removes the limit.
+func WithMaxPendingHandshakes(n int) ServerOption {
+	return func(o *serverOptions) {
+		o.maxPendingHandshakes = n
+	}
+}
+
+// WithMaxPendingHandshakesPerSource limits how many of the pending
+// handshakes a single source address may hold, further connections of the
+// source are dropped. 0 removes the limit.
+func WithMaxPendingHandshakesPerSource(n int) ServerOption {
+	return func(o *serverOptions) {
+		o.maxPendingPerSource = n
+	}
+}
+
+// WithMaxFrameSize limits the size of a single control message received from
+// a client.
+func WithMaxFrameSize(size int) ServerOption {
+	return func(o *serverOptions) {
+		o.maxFrameSize = size
+	}
+}
+
+// WithDialAllowlist lets keys open forward tunnels to the destinations
+// listed for them, on top of their Identity.Dials.
+func WithDialAllowlist(dials map[string][]string) ServerOption {
+	return func(o *serverOptions) {
+		o.dials = dials
+	}
+}
+
+// WithPeerACL lets clients reach each other with Client.DialPeer. It maps
+// the key of the dialing client to the keys of the peers it may reach, "*"
+// for every peer, and to the targets it may reach through them, see
+// Identity.CanDial for the patterns. The peer must allow the target too.
+func WithPeerACL(acl map[string]map[string][]string) ServerOption {
+	return func(o *serverOptions) {
+		o.peers = acl
+	}
+}
+
+// WithUnixBindDir lets clients bind "unix:/path" sockets inside dir, unix
+// binds are refused without it.
+func WithUnixBindDir(dir string) ServerOption {
+	return func(o *serverOptions) {
+		if abs, err := filepath.Abs(dir); err == nil {
+			dir = abs
+		}
+		o.unixBindDir = dir
+	}
+}
+
+// WithTunnelBandwidth limits every tunnel of a key on its own, "*" applies
+// to keys without a limit.
+func WithTunnelBandwidth(limits map[string]Bandwidth) ServerOption {
+	return func(o *serverOptions) {
+		o.tunnelBandwidth = limits
+	}
+}
+
+// WithKeyBandwidth limits all tunnels of a key together, "*" applies to keys
+// without a limit and gives each of them a limit of its own.
+func WithKeyBandwidth(limits map[string]Bandwidth) ServerOption {
+	return func(o *serverOptions) {
+		o.keyBandwidth = limits
+	}
+}
+
+// WithQuotas limits how many bytes the tunnels of a key move within a rolling
+// window, "*" gives keys without a quota one of their own. Tunnels exceeding
+// the quota are closed and new tunnels of the key are refused until usage
+// leaves the window. The usage is saved to file, when it is not empty, and
+// restored from it by NewServer.
+func WithQuotas(quotas map[string]Quota, file string) ServerOption {
+	return func(o *serverOptions) {
+		o.quotas = quotas
+		o.quotaFile = file
+	}
+}
+
+// WithMaxStreams caps the concurrent streams of every tunnel, clients may
+// only ask for fewer with TunnelOptions.MaxStreams.
+func WithMaxStreams(n int) ServerOption {
+	return func(o *serverOptions) {
+		o.maxStreams = n
+	}
+}
+
+// WithSourcePolicy restricts the public sources that may reach any tunnel,
+// and with keys the tunnels of single keys. The policies of the server always
+// apply, tunnels can only narrow them down with TunnelOptions.AllowSources
+// and DenySources.
+func WithSourcePolicy(global SourcePolicy, keys map[string]SourcePolicy) ServerOption {
+	return func(o *serverOptions) {
+		o.sources = global
+		o.keySources = keys
+	}
+}
+
+// WithSourceLimits bans public sources that connect too often or keep
+// failing, see DefaultSourceLimits. Bans are managed with Server.Bans, Ban and
+// Unban.
+func WithSourceLimits(limits SourceLimits) ServerOption {
+	return func(o *serverOptions) {
+		o.sourceLimits = limits
+	}
+}
+
+func defaultServerOptions() serverOptions {
+	return serverOptions{
+		authLimits:           DefaultAuthLimits,
+		handshakeTimeout:     time.Second * 10,
+		maxPendingHandshakes: 64,
+		maxPendingPerSource:  8,
+		maxFrameSize:         protocol.DefaultMaxFrameSize,
+	}
+}
+
+type clientOptions struct {
+	privateKey     ed25519.PrivateKey
+	serverKey      ed25519.PublicKey
+	token          string
+	encrypt        bool
+	tunnel         protocol.TunnelOptions
+	dial           func(ctx context.Context, network, addr string) (net.Conn, error)
+	tls            *tls.Config
+	connectTimeout time.Duration
+	maxFrameSize   int
+	dials          []string
+	acceptBacklog  int
+	acceptFilter   func(local, remote net.Addr) error
+}
+
+type ClientOption func(*clientOptions)
+
+// WithPrivateKey authenticates the client by signing the server challenge
+// instead of using a shared secret.
+func WithPrivateKey(key ed25519.PrivateKey) ClientOption {
+	return func(o *clientOptions) {
+		o.privateKey = key
+	}
+}
+
+// WithServerKey is the host key the server must sign its proof with when the
+// client authenticates with a private key.
+func WithServerKey(key ed25519.PublicKey) ClientOption {
+	return func(o *clientOptions) {
+		o.serverKey = key
+	}
+}
+
+// WithToken authenticates with a token from NewToken, the key and secret
+// given to NewClient are ignored.
+func WithToken(token string) ClientOption {
+	return func(o *clientOptions) {
+		o.token = token
+	}
+}
+
+// WithEncryption encrypts the control connection, and with it all tunneled
+// traffic, with a key derived from the shared secret or token. It is not
+// available with WithPrivateKey.
+func WithEncryption() ClientOption {
+	return func(o *clientOptions) {
+		o.encrypt = true
+	}
+}
+
+// WithTunnelOptions requests per tunnel options from the server, what was
+// granted is reported by Client.Tunnel.
+func WithTunnelOptions(options protocol.TunnelOptions) ClientOption {
+	return func(o *clientOptions) {
+		o.tunnel = options
+	}
+}
+
+// WithDialer replaces dialing the server address, e.g. with WebSocketDialer.
+func WithDialer(dial func(ctx context.Context, network, addr string) (net.Conn, error)) ClientOption {
+	return func(o *clientOptions) {
+		o.dial = dial
+	}
+}
+
+// WithTLS connects to a server serving its control port over TLS.
+func WithTLS(config *tls.Config) ClientOption {
+	return func(o *clientOptions) {
+		o.tls = config
+	}
+}
+
+// WithConnectTimeout bounds dialing the server and authenticating to it.
+func WithConnectTimeout(timeout time.Duration) ClientOption {
+	return func(o *clientOptions) {
+		o.connectTimeout = timeout
+	}
+}
+
+// WithClientMaxFrameSize limits the size of a single control message received
+// from the server.
+func WithClientMaxFrameSize(size int) ClientOption {
+	return func(o *clientOptions) {
+		o.maxFrameSize = size
+	}
+}
+
+// WithClientDialAllowlist are the destinations the server may reach through
+// this client with Server.DialTunnel, see Identity.CanDial for the patterns.
+func WithClientDialAllowlist(patterns ...string) ClientOption {
+	return func(o *clientOptions) {
+		o.dials = append(o.dials, patterns...)
+	}
+}
+
+// WithAcceptBacklog is how many public connections may wait for Accept,
+// further connections are refused and the server closes them right away.
+func WithAcceptBacklog(n int) ClientOption {
+	return func(o *clientOptions) {
+		o.acceptBacklog = n
+	}
+}
+
+// WithAcceptFilter refuses the public connections and udp sources filter
+// returns an error for, before they reach Accept or the PacketConn.
+func WithAcceptFilter(filter func(local, remote net.Addr) error) ClientOption {
+	return func(o *clientOptions) {
+		o.acceptFilter = filter
+	}
+}
+
+func defaultClientOptions() clientOptions {
+	return clientOptions{
+		connectTimeout: time.Second * 30,
+		maxFrameSize:   protocol.DefaultMaxFrameSize,
+		acceptBacklog:  protocol.DefaultAcceptBacklog,
+	}
+}
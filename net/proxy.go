@@ -0,0 +1,20 @@
+package net
+
+import (
+	"fmt"
+	"net"
+)
+
+// proxyHeader is the PROXY protocol v1 line describing a public connection.
+func proxyHeader(remote, local net.Addr) []byte {
+	src, srcOk := remote.(*net.TCPAddr)
+	dst, dstOk := local.(*net.TCPAddr)
+	if !srcOk || !dstOk {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	family := "TCP4"
+	if src.IP.To4() == nil || dst.IP.To4() == nil {
+		family = "TCP6"
+	}
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, src.IP.String(), dst.IP.String(), src.Port, dst.Port))
+}
@@ -0,0 +1,194 @@
+package net
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// quotaSlots is how many slots a quota window is tracked in, usage leaves the
+// rolling window one slot at a time.
+const quotaSlots = 60
+
+// Quota limits the bytes the tunnels of a key move towards their clients and
+// back from them within a rolling Window, zero is unlimited.
+type Quota struct {
+	ToClient   int64
+	FromClient int64
+	Window     time.Duration
+}
+
+type quotaSlot struct {
+	Start      int64 `json:"start"`
+	ToClient   int64 `json:"to_client"`
+	FromClient int64 `json:"from_client"`
+}
+
+// quotas tracks the usage of every key with a Quota and persists it to path
+// so restarting the server does not reset it.
+type quotas struct {
+	limits map[string]Quota
+	path   string
+
+	usage map[string][]quotaSlot
+	dirty bool
+	sync  sync.Mutex
+}
+
+// _quotaFor looks up the quota of key, "*" applies to keys without one.
+func (q *quotas) _quotaFor(key string) (Quota, bool) {
+	if quota, ok := q.limits[key]; ok {
+		return quota, true
+	}
+	quota, ok := q.limits["*"]
+	return quota, ok
+}
+
+func (q *quotas) _slotSize(quota Quota) int64 {
+	size := int64(quota.Window / quotaSlots / time.Second)
+	if size < 1 {
+		size = 1
+	}
+	return size
+}
+
+// _used drops the slots that left the window of key and sums the rest.
+func (q *quotas) _used(key string, quota Quota, now time.Time) (toClient, fromClient int64) {
+	slots := q.usage[key]
+	from := now.Add(-quota.Window).Unix()
+	kept := slots[:0]
+	for _, slot := range slots {
+		if slot.Start+q._slotSize(quota) > from {
+			kept = append(kept, slot)
+			toClient += slot.ToClient
+			fromClient += slot.FromClient
+		}
+	}
+	if len(kept) != len(slots) {
+		q.dirty = true
+	}
+	if len(kept) == 0 {
+		delete(q.usage, key)
+	} else {
+		q.usage[key] = kept
+	}
+	return toClient, fromClient
+}
+
+func _quotaError(quota Quota, toClient, fromClient int64) error {
+	if quota.ToClient > 0 && toClient > quota.ToClient {
+		return fmt.Errorf("quota of %d bytes to the client per %s exceeded", quota.ToClient, quota.Window)
+	}
+	if quota.FromClient > 0 && fromClient > quota.FromClient {
+		return fmt.Errorf("quota of %d bytes from the client per %s exceeded", quota.FromClient, quota.Window)
+	}
+	return nil
+}
+
+// check fails when key already used up its quota.
+func (q *quotas) check(key string) error {
+	if q == nil {
+		return nil
+	}
+	quota, ok := q._quotaFor(key)
+	if !ok {
+		return nil
+	}
+	q.sync.Lock()
+	defer q.sync.Unlock()
+	toClient, fromClient := q._used(key, quota, time.Now())
+	// a key without a single byte left is out of quota already
+	return _quotaError(quota, toClient+1, fromClient+1)
+}
+
+// add counts n bytes for key and fails when they exceed its quota.
+func (q *quotas) add(key string, toClient bool, n int64, now time.Time) error {
+	if q == nil {
+		return nil
+	}
+	quota, ok := q._quotaFor(key)
+	if !ok {
+		return nil
+	}
+	q.sync.Lock()
+	defer q.sync.Unlock()
+	usedTo, usedFrom := q._used(key, quota, now)
+	start := now.Unix() - now.Unix()%q._slotSize(quota)
+	slots := q.usage[key]
+	if len(slots) == 0 || slots[len(slots)-1].Start != start {
+		slots = append(slots, quotaSlot{Start: start})
+	}
+	slot := &slots[len(slots)-1]
+	if toClient {
+		slot.ToClient += n
+		usedTo += n
+	} else {
+		slot.FromClient += n
+		usedFrom += n
+	}
+	q.usage[key] = slots
+	q.dirty = true
+	return _quotaError(quota, usedTo, usedFrom)
+}
+
+// save writes the usage to path when it changed since the last save.
+func (q *quotas) save() error {
+	if q == nil || q.path == "" {
+		return nil
+	}
+	q.sync.Lock()
+	if !q.dirty {
+		q.sync.Unlock()
+		return nil
+	}
+	raw, err := json.Marshal(q.usage)
+	q.dirty = false
+	q.sync.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(q.path), filepath.Base(q.path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(raw); err == nil {
+		err = tmp.Close()
+	} else {
+		_ = tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), q.path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// loadQuotas restores the usage saved to path, a missing file starts empty.
+func loadQuotas(limits map[string]Quota, path string) (*quotas, error) {
+	out := &quotas{
+		limits: limits,
+		path:   path,
+		usage:  make(map[string][]quotaSlot),
+	}
+	if path == "" {
+		return out, nil
+	}
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return out, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(raw, &out.usage); err != nil {
+		return nil, fmt.Errorf("malformed quota file %s: %w", path, err)
+	}
+	return out, nil
+}
@@ -1,17 +1,35 @@
 package net
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"github.com/zbrumen/remote-serve/protocol"
 	"net"
+	"path/filepath"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
 )
 
 type Server struct {
 	comLinkServer net.Listener
-	auth          map[string]string
+	auth          Authenticator
+	options       serverOptions
 
-	done chan struct{}
-	once sync.Once
+	done    chan struct{}
+	once    sync.Once
+	pending chan struct{}
+
+	pendingSources map[string]int
+	pendingSync    sync.Mutex
+
+	keyBandwidth *keyBandwidth
+	quotas       *quotas
+	sources      *sourceFilter
+	keySources   map[string]*sourceFilter
+	bans         *sourceBans
 
 	conns map[string]*serverConn
 	sync  sync.RWMutex
@@ -26,13 +44,53 @@ func (s *Server) Close() error {
 	s.once.Do(func() {
 		close(s.done)
 	})
+	if err := s.quotas.save(); err != nil {
+		fmt.Println("remote-serve: CANNOT SAVE QUOTAS: " + err.Error())
+	}
 	return s.comLinkServer.Close()
 }
 
+func (s *Server) Addr() net.Addr {
+	return s.comLinkServer.Addr()
+}
+
 func (s *Server) Done() <-chan struct{} {
 	return s.done
 }
 
+func (s *Server) limiterBackend() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			if s.options.limiter != nil {
+				s.options.limiter.cleanup()
+			}
+			if s.bans != nil {
+				s.bans.cleanup()
+			}
+		}
+	}
+}
+
+func (s *Server) quotaBackend() {
+	ticker := time.NewTicker(time.Second * 10)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			if err := s.quotas.save(); err != nil {
+				fmt.Println("remote-serve: CANNOT SAVE QUOTAS: " + err.Error())
+			}
+		}
+	}
+}
+
 func (s *Server) clientsBackend() {
 	for {
 		client, err := s.comLinkServer.Accept()
@@ -46,47 +104,333 @@ func (s *Server) clientsBackend() {
 			s.sync.Unlock()
 			return
 		}
-		receiver, sender, name, port, err := serverSideAuth(client, s.auth)
-		if err != nil {
-			fmt.Println("remote-serve: CLIENT_AUTH ERROR: " + err.Error())
-		} else {
-			// break previous connections and reestablish
+		s.accept(client)
+	}
+}
+
+func (s *Server) accept(client net.Conn) {
+	source := _authSource(client.RemoteAddr())
+	if s.options.limiter.checkSource(source) != nil {
+		// the refusal must not wait on a peer that never reads it
+		if s.options.handshakeTimeout <= 0 || client.SetDeadline(time.Now().Add(s.options.handshakeTimeout)) != nil {
+			_ = client.Close()
+			return
+		}
+		go func() {
+			_ = _authReject(client, protocol.ErrorRateLimited, "")
+		}()
+		return
+	}
+	if !s.reservePending(source) {
+		fmt.Println("remote-serve: TOO MANY PENDING HANDSHAKES FROM " + source + ", DROPPING " + client.RemoteAddr().String())
+		_ = client.Close()
+		return
+	}
+	if s.pending == nil {
+		go s.handshake(client, source)
+		return
+	}
+	select {
+	case s.pending <- struct{}{}:
+		go s.handshake(client, source)
+	default:
+		s.releasePending(source)
+		fmt.Println("remote-serve: TOO MANY PENDING HANDSHAKES, DROPPING " + client.RemoteAddr().String())
+		_ = client.Close()
+	}
+}
+
+// reservePending counts a handshake of source, a single source may only
+// hold a few of the pending handshake slots.
+func (s *Server) reservePending(source string) bool {
+	s.pendingSync.Lock()
+	defer s.pendingSync.Unlock()
+	if limit := s.options.maxPendingPerSource; limit > 0 && s.pendingSources[source] >= limit {
+		return false
+	}
+	s.pendingSources[source]++
+	return true
+}
+
+func (s *Server) releasePending(source string) {
+	s.pendingSync.Lock()
+	defer s.pendingSync.Unlock()
+	if s.pendingSources[source]--; s.pendingSources[source] <= 0 {
+		delete(s.pendingSources, source)
+	}
+}
+
+func (s *Server) finishHandshake(source string) {
+	if s.pending != nil {
+		<-s.pending
+	}
+	s.releasePending(source)
+}
+
+func (s *Server) grant(identity *Identity, req protocol.TunnelRequest) (protocol.TunnelOptions, map[string]string, string) {
+	errs := make(map[string]string)
+	granted := protocol.TunnelOptions{
+		ProxyProtocol: req.Options.ProxyProtocol,
+		IdleTimeout:   req.Options.IdleTimeout,
+		MaxStreams:    req.Options.MaxStreams,
+		Labels:        req.Options.Labels,
+		Mirror:        req.Options.Mirror,
+		MirrorRate:    req.Options.MirrorRate,
+		AllowSources:  req.Options.AllowSources,
+		DenySources:   req.Options.DenySources,
+	}
+	code := ""
+	switch req.Options.Protocol {
+	case "", "tcp":
+		granted.Protocol = "tcp"
+	case "udp":
+		granted.Protocol = "udp"
+		if req.Options.ProxyProtocol {
+			errs["options.proxy_protocol"] = "not supported for udp"
+			granted.ProxyProtocol = false
+		}
+	default:
+		errs["options.protocol"] = "unsupported protocol " + req.Options.Protocol
+		code = protocol.ErrorBadRequest
+	}
+	if network, path := _splitNetwork(req.Bind); network == "unix" {
+		if granted.Protocol == "udp" {
+			errs["bind"] = "udp tunnels need a host:port bind"
+			code = protocol.ErrorBadRequest
+		} else if !_unixBindAllowed(s.options.unixBindDir, path) {
+			errs["bind"] = "unix binds are only allowed in the unix bind directory"
+			code = protocol.ErrorForbiddenAddress
+		}
+	}
+	if !identity.CanBind(req.Bind) {
+		errs["bind"] = identity.Key + " may not bind " + req.Bind
+		code = protocol.ErrorForbiddenAddress
+	}
+	if _, err := newSourceFilter(SourcePolicy{Allow: req.Options.AllowSources, Deny: req.Options.DenySources}); err != nil {
+		errs["options.sources"] = err.Error()
+		code = protocol.ErrorBadRequest
+	}
+	if err := s.quotas.check(identity.Key); err != nil {
+		errs["key"] = err.Error()
+		code = protocol.ErrorQuotaExceeded
+	}
+	if len(req.Options.Hostnames) > 0 {
+		errs["options.hostnames"] = "hostname routing is not supported"
+	}
+	if req.Options.IdleTimeout < 0 {
+		errs["options.idle_timeout"] = "must not be negative"
+		granted.IdleTimeout = 0
+	}
+	if req.Options.MaxStreams < 0 {
+		errs["options.max_streams"] = "must not be negative"
+		granted.MaxStreams = 0
+	}
+	if limit := s.options.maxStreams; limit > 0 && (granted.MaxStreams == 0 || granted.MaxStreams > limit) {
+		if granted.MaxStreams > limit {
+			errs["options.max_streams"] = fmt.Sprintf("limited to %d", limit)
+		}
+		granted.MaxStreams = limit
+	}
+	if granted.Mirror {
+		if granted.Protocol != "tcp" {
+			errs["options.mirror"] = "only tcp tunnels can be mirrored"
+			code = protocol.ErrorBadRequest
+		}
+		if req.Options.MirrorRate == 0 {
+			granted.MirrorRate = 1
+		} else if req.Options.MirrorRate < 0 || req.Options.MirrorRate > 1 {
+			errs["options.mirror_rate"] = "must be between 0 and 1"
+			code = protocol.ErrorBadRequest
+		}
+	} else {
+		granted.MirrorRate = 0
+	}
+	return granted, errs, code
+}
+
+// _splitNetwork tells "unix:/path" addresses apart from tcp host:port ones.
+func _splitNetwork(addr string) (network, address string) {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		return "unix", strings.TrimPrefix(path, "//")
+	}
+	return "tcp", addr
+}
+
+func _unixBindAllowed(dir, path string) bool {
+	if dir == "" || !filepath.IsAbs(path) {
+		return false
+	}
+	rel, err := filepath.Rel(dir, filepath.Clean(path))
+	return err == nil && rel != "." && !strings.HasPrefix(rel, "..")
+}
+
+func _listenError(err error) string {
+	switch {
+	case errors.Is(err, syscall.EADDRINUSE):
+		return protocol.ErrorAddressInUse
+	case errors.Is(err, syscall.EACCES), errors.Is(err, syscall.EADDRNOTAVAIL):
+		return protocol.ErrorForbiddenAddress
+	default:
+		return protocol.ErrorUnavailable
+	}
+}
+
+func (s *Server) handshake(client net.Conn, source string) {
+	h, err := serverSideAuth(client, s.auth, &s.options)
+	if err != nil {
+		s.finishHandshake(source)
+		fmt.Println("remote-serve: CLIENT_AUTH ERROR: " + err.Error())
+		_ = client.Close()
+		return
+	}
+	port := h.request.Bind
+	granted, errs, code := s.grant(h.identity, h.request)
+	var listener net.Listener
+	var packets net.PacketConn
+	var bound net.Addr
+	if code == "" && granted.Mirror {
+		// a shadow replaces the previous shadow of the bind but never listens
+		if primary := s.mirrored(h.identity.Key, h.request.Bind); primary != nil {
+			port = "mirror://" + primary.bind
 			s.sync.Lock()
 			if c, ok := s.conns[port]; ok {
 				_ = c.Close()
 				delete(s.conns, port)
 			}
-			conn, err := newServerConn(port, name, receiver, sender)
-			if err == nil {
-				s.conns[port] = conn
-				go func() {
-					<-conn.Context().Done()
-					s.sync.Lock()
-					delete(s.conns, port)
-					s.sync.Unlock()
-					fmt.Println("remote-serve: SERVER " + port + " IS CLOSING")
-				}()
-			} else {
-				fmt.Println("remote-serve: CANNOT CREATE SERVER ERROR: " + err.Error())
-				_ = client.Close()
+			s.sync.Unlock()
+		} else {
+			errs["bind"] = "no tunnel of " + h.identity.Key + " is bound to " + h.request.Bind
+			code = protocol.ErrorForbiddenAddress
+		}
+	} else if code == "" {
+		if granted.Protocol == "udp" {
+			port = "udp://" + port
+		}
+		// break previous connections and reestablish
+		s.sync.Lock()
+		if c, ok := s.conns[port]; ok {
+			_ = c.Close()
+			delete(s.conns, port)
+		}
+		if granted.Protocol == "udp" {
+			if packets, err = net.ListenPacket("udp", h.request.Bind); err == nil {
+				bound = packets.LocalAddr()
+			}
+		} else if listener, err = net.Listen(_splitNetwork(h.request.Bind)); err == nil {
+			bound = listener.Addr()
+		}
+		s.sync.Unlock()
+		if err != nil {
+			fmt.Println("remote-serve: CANNOT CREATE SERVER ERROR: " + err.Error())
+			errs["bind"] = err.Error()
+			code = _listenError(err)
+		} else if _, p, _ := net.SplitHostPort(h.request.Bind); p == "0" {
+			// ephemeral binds never replace each other
+			port = bound.Network() + "://" + bound.String()
+		}
+	}
+	resp := protocol.TunnelResponse{Granted: granted, Errors: errs, Error: code}
+	if bound != nil {
+		resp.Bind = bound.String()
+		if bound.Network() == "unix" {
+			resp.Bind = "unix:" + resp.Bind
+		}
+	} else if code == "" && granted.Mirror {
+		resp.Bind = strings.TrimPrefix(port, "mirror://")
+	}
+	var conn *serverConn
+	err = h.respond(resp, func(tunnel net.Conn) error {
+		session := protocol.NewSession(tunnel, false, protocol.WithSessionMaxFrameSize(s.options.maxFrameSize))
+		conn = newServerConn(resp.Bind, listener, packets, h.identity, granted, s, session)
+		s.sync.Lock()
+		s.conns[port] = conn
+		s.sync.Unlock()
+		go func() {
+			<-conn.Context().Done()
+			s.sync.Lock()
+			if s.conns[port] == conn {
+				delete(s.conns, port)
 			}
 			s.sync.Unlock()
+			fmt.Println("remote-serve: SERVER " + port + " IS CLOSING")
+		}()
+		return nil
+	})
+	s.finishHandshake(source)
+	if err != nil {
+		fmt.Println("remote-serve: CLIENT_AUTH ERROR: " + err.Error())
+		_ = client.Close()
+		if conn != nil {
+			_ = conn.Close()
+		}
+		if listener != nil {
+			_ = listener.Close()
+		}
+		if packets != nil {
+			_ = packets.Close()
 		}
+		return
 	}
+	conn.start()
 }
 
-func NewServer(addr string, auth map[string]string) (*Server, error) {
-	listener, err := net.Listen("tcp", addr)
+// NewServer listens for clients on a tcp host:port or a "unix:/path" addr.
+func NewServer(addr string, auth Authenticator, opts ...ServerOption) (*Server, error) {
+	var options = defaultServerOptions()
+	for _, opt := range opts {
+		opt(&options)
+	}
+	quotas, err := loadQuotas(options.quotas, options.quotaFile)
+	if err != nil {
+		return nil, err
+	}
+	sources, err := newSourceFilter(options.sources)
 	if err != nil {
 		return nil, err
 	}
+	keySources := make(map[string]*sourceFilter)
+	for key, policy := range options.keySources {
+		if keySources[key], err = newSourceFilter(policy); err != nil {
+			return nil, fmt.Errorf("source policy of %s: %w", key, err)
+		}
+	}
+	listener, err := net.Listen(_splitNetwork(addr))
+	if err != nil {
+		return nil, err
+	}
+	if options.tlsConfig != nil {
+		listener = tls.NewListener(listener, options.tlsConfig)
+	}
 	out := &Server{
-		comLinkServer: listener,
-		auth:          auth,
-		done:          make(chan struct{}),
-		once:          sync.Once{},
-		conns:         make(map[string]*serverConn),
-		sync:          sync.RWMutex{},
+		comLinkServer:  listener,
+		auth:           auth,
+		done:           make(chan struct{}),
+		once:           sync.Once{},
+		conns:          make(map[string]*serverConn),
+		pendingSources: make(map[string]int),
+		sync:           sync.RWMutex{},
+		options:        options,
+		sources:        sources,
+		keySources:     keySources,
+	}
+	if len(options.keyBandwidth) > 0 {
+		out.keyBandwidth = newKeyBandwidth(options.keyBandwidth)
+	}
+	if len(options.quotas) > 0 {
+		out.quotas = quotas
+		go out.quotaBackend()
+	}
+	if out.options.maxPendingHandshakes > 0 {
+		out.pending = make(chan struct{}, out.options.maxPendingHandshakes)
+	}
+	if out.options.authLimits != (AuthLimits{}) {
+		out.options.limiter = newAuthLimiter(out.options.authLimits)
+	}
+	if out.options.sourceLimits != (SourceLimits{}) {
+		out.bans = newSourceBans(out.options.sourceLimits)
+	}
+	if out.options.limiter != nil || out.bans != nil {
+		go out.limiterBackend()
 	}
 	go out.clientsBackend()
 	return out, nil
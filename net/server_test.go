@@ -0,0 +1,264 @@
+package net
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"github.com/zbrumen/remote-serve/protocol"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSilentClientDoesNotBlockHandshakes(t *testing.T) {
+	srvr, err := NewServer("127.0.0.1:0", StaticAuthenticator{"username": "password"}, WithHandshakeTimeout(time.Millisecond*500))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srvr.Close()
+	addr := srvr.comLinkServer.Addr().String()
+	silent, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	client, err := NewClient("tcp", addr, "username", "password", "127.0.0.1:0", WithConnectTimeout(time.Millisecond*200))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = client.Close()
+	_ = silent.SetReadDeadline(time.Now().Add(time.Second * 2))
+	if _, err = silent.Read(make([]byte, 1)); err == nil || strings.Contains(err.Error(), "timeout") {
+		t.Fatal("silent client was not disconnected by the handshake timeout")
+	}
+}
+
+func TestOversizedHello(t *testing.T) {
+	srvr, err := NewServer("127.0.0.1:0", StaticAuthenticator{"username": "password"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srvr.Close()
+	conn, err := net.Dial("tcp", srvr.comLinkServer.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, _ = conn.Write([]byte(strings.Repeat("A", maxHelloSize*2)))
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second * 2))
+	if _, err = conn.Read(make([]byte, 1)); err == nil || strings.Contains(err.Error(), "timeout") {
+		t.Fatal("oversized hello did not close the connection")
+	}
+}
+
+func TestTunnelOptions(t *testing.T) {
+	srvr, err := NewServer("127.0.0.1:0", StaticAuthenticator{"username": "password"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srvr.Close()
+	client, err := NewClient("tcp", srvr.comLinkServer.Addr().String(), "username", "password", "127.0.0.1:0", WithTunnelOptions(protocol.TunnelOptions{
+		ProxyProtocol: true,
+		Hostnames:     []string{"example.com"},
+		Labels:        map[string]string{"env": "test"},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	tunnel := client.Tunnel()
+	if tunnel.Bind == "" || tunnel.Granted.Protocol != "tcp" || !tunnel.Granted.ProxyProtocol || tunnel.Granted.Labels["env"] != "test" {
+		t.Fatalf("unexpected grant %+v", tunnel)
+	}
+	if tunnel.Errors["options.hostnames"] == "" {
+		t.Fatal("unsupported hostnames were not reported")
+	}
+	public, err := net.Dial("tcp", tunnel.Bind)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer public.Close()
+	conn, err := client.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	header, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(header, "PROXY TCP4 127.0.0.1 127.0.0.1 ") {
+		t.Fatal("unexpected proxy header " + header)
+	}
+
+	if _, err = NewClient("tcp", srvr.comLinkServer.Addr().String(), "username", "password", "127.0.0.1:0", WithTunnelOptions(protocol.TunnelOptions{
+		Protocol: "sctp",
+	})); err == nil {
+		t.Fatal("unsupported protocol was granted")
+	}
+}
+
+func TestTunnelErrors(t *testing.T) {
+	srvr, err := NewServer("127.0.0.1:0", StaticAuthenticator{"username": "password"}, WithAuthLimits(AuthLimits{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srvr.Close()
+	addr := srvr.comLinkServer.Addr().String()
+	if _, err = NewClient("tcp", addr, "username", "wrong", "127.0.0.1:0"); !errors.Is(err, ErrUnauthorized) {
+		t.Fatal("expected ErrUnauthorized, got", err)
+	}
+	if _, err = NewClient("tcp", addr, "nobody", "password", "127.0.0.1:0"); !errors.Is(err, ErrUnauthorized) {
+		t.Fatal("expected ErrUnauthorized, got", err)
+	}
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	_, err = NewClient("tcp", addr, "username", "password", taken.Addr().String())
+	var tunnelErr *TunnelError
+	if !errors.Is(err, ErrAddressInUse) || !errors.As(err, &tunnelErr) || !tunnelErr.Temporary() {
+		t.Fatal("expected a temporary ErrAddressInUse, got", err)
+	}
+}
+
+func expectClosed(t *testing.T, public net.Conn) {
+	t.Helper()
+	_ = public.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if _, err := public.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatal("expected the public connection to be closed, got", err)
+	}
+}
+
+func TestStreamLimits(t *testing.T) {
+	srvr, err := NewServer("127.0.0.1:0", StaticAuthenticator{"username": "password"}, WithMaxStreams(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srvr.Close()
+	capped, err := NewClient("tcp", srvr.Addr().String(), "username", "password", "127.0.0.1:0", WithTunnelOptions(protocol.TunnelOptions{
+		MaxStreams: 5,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer capped.Close()
+	if capped.Tunnel().Granted.MaxStreams != 1 || capped.Tunnel().Errors["options.max_streams"] == "" {
+		t.Fatalf("max streams were not capped %+v", capped.Tunnel())
+	}
+	first, err := net.Dial("tcp", capped.Tunnel().Bind)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	if _, err = capped.Accept(); err != nil {
+		t.Fatal(err)
+	}
+	second, err := net.Dial("tcp", capped.Tunnel().Bind)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	expectClosed(t, second)
+	// streams dialed through the tunnel share the same slots
+	if _, err = srvr.DialTunnel(context.Background(), "username", "127.0.0.1:1"); !errors.Is(err, ErrServerUnavailable) {
+		t.Fatal("dialed through a tunnel without free streams", err)
+	}
+
+	backlog, err := NewClient("tcp", srvr.Addr().String(), "username", "password", "127.0.0.1:0", WithAcceptBacklog(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backlog.Close()
+	waiting, err := net.Dial("tcp", backlog.Tunnel().Bind)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer waiting.Close()
+	expectClosed(t, waiting)
+
+	filtered, err := NewClient("tcp", srvr.Addr().String(), "username", "password", "127.0.0.1:0", WithAcceptFilter(func(local, remote net.Addr) error {
+		return errors.New("not today")
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer filtered.Close()
+	refused, err := net.Dial("tcp", filtered.Tunnel().Bind)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer refused.Close()
+	expectClosed(t, refused)
+}
+
+func TestBannedSourceBeforeHello(t *testing.T) {
+	srvr, err := NewServer("127.0.0.1:0", StaticAuthenticator{"username": "password", "guest": "guest"}, WithAuthLimits(AuthLimits{
+		BaseDelay: time.Hour,
+		MaxDelay:  time.Hour,
+		BanAfter:  1,
+		BanFor:    time.Hour,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srvr.Close()
+	addr := srvr.Addr().String()
+	if _, err = NewClient("tcp", addr, "username", "wrong", "127.0.0.1:0"); !errors.Is(err, ErrUnauthorized) {
+		t.Fatal("expected ErrUnauthorized, got", err)
+	}
+	// a valid key does not lift the ban of the source
+	if _, err = NewClient("tcp", addr, "guest", "guest", "127.0.0.1:0"); !errors.Is(err, ErrRateLimited) {
+		t.Fatal("expected ErrRateLimited, got", err)
+	}
+	silent, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	_ = silent.SetReadDeadline(time.Now().Add(time.Second * 2))
+	if _, err = io.ReadAll(silent); err != nil {
+		t.Fatal("banned source kept its handshake open", err)
+	}
+}
+
+func TestPendingHandshakesPerSource(t *testing.T) {
+	srvr, err := NewServer("127.0.0.1:0", StaticAuthenticator{"username": "password"}, WithMaxPendingHandshakesPerSource(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srvr.Close()
+	addr := srvr.Addr().String()
+	for i := 0; i < 2; i++ {
+		silent, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer silent.Close()
+	}
+	dropped, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dropped.Close()
+	_ = dropped.SetReadDeadline(time.Now().Add(time.Second * 2))
+	if _, err = dropped.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatal("source over its pending handshakes was not dropped", err)
+	}
+}
+
+func TestUnlimitedPendingHandshakes(t *testing.T) {
+	srvr, err := NewServer("127.0.0.1:0", StaticAuthenticator{"username": "password"}, WithMaxPendingHandshakes(0), WithMaxPendingHandshakesPerSource(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srvr.Close()
+	client, err := NewClient("tcp", srvr.Addr().String(), "username", "password", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = client.Close()
+}
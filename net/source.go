@@ -0,0 +1,109 @@
+package net
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// SourcePolicy restricts the public sources that may reach a tunnel. Allow
+// and Deny hold CIDRs or single IPs, a source matching Deny is refused and
+// when Allow is not empty a source has to match it too.
+type SourcePolicy struct {
+	Allow []string
+	Deny  []string
+}
+
+type sourceFilter struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+func _parsePrefixes(list []string) ([]netip.Prefix, error) {
+	var out []netip.Prefix
+	for _, raw := range list {
+		raw = strings.TrimSpace(raw)
+		if !strings.Contains(raw, "/") {
+			addr, err := netip.ParseAddr(raw)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address %s", raw)
+			}
+			addr = addr.Unmap()
+			out = append(out, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr %s", raw)
+		}
+		out = append(out, prefix.Masked())
+	}
+	return out, nil
+}
+
+// newSourceFilter compiles policy, it returns nil for an empty policy.
+func newSourceFilter(policy SourcePolicy) (*sourceFilter, error) {
+	allow, err := _parsePrefixes(policy.Allow)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := _parsePrefixes(policy.Deny)
+	if err != nil {
+		return nil, err
+	}
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+	return &sourceFilter{allow: allow, deny: deny}, nil
+}
+
+func _containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *sourceFilter) allows(addr netip.Addr) bool {
+	if f == nil {
+		return true
+	}
+	if _containsAddr(f.deny, addr) {
+		return false
+	}
+	return len(f.allow) == 0 || _containsAddr(f.allow, addr)
+}
+
+// _sourceAddr is the IP of a tcp or udp source, unix sockets have none.
+func _sourceAddr(addr net.Addr) (netip.Addr, bool) {
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+	case *net.UDPAddr:
+		ip = addr.IP
+	default:
+		return netip.Addr{}, false
+	}
+	out, ok := netip.AddrFromSlice(ip)
+	return out.Unmap(), ok
+}
+
+// allowSource checks a public source against the policies of the server, of
+// the key and of the tunnel. Every one of them has to allow it, so a tunnel
+// can only narrow down what the server allows.
+func (s *serverConn) allowSource(addr net.Addr) bool {
+	ip, ok := _sourceAddr(addr)
+	if !ok {
+		return true
+	}
+	for _, filter := range s.sources {
+		if !filter.allows(ip) {
+			return false
+		}
+	}
+	return true
+}
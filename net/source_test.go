@@ -0,0 +1,97 @@
+package net
+
+import (
+	"errors"
+	"github.com/zbrumen/remote-serve/protocol"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestSourceFilter(t *testing.T) {
+	filter, err := newSourceFilter(SourcePolicy{
+		Allow: []string{"10.0.0.0/8", "192.168.1.7"},
+		Deny:  []string{"10.1.0.0/16"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for addr, allowed := range map[string]bool{
+		"10.2.3.4":    true,
+		"10.1.3.4":    false,
+		"192.168.1.7": true,
+		"192.168.1.8": false,
+		"::1":         false,
+	} {
+		if filter.allows(netip.MustParseAddr(addr)) != allowed {
+			t.Fatal("unexpected decision for " + addr)
+		}
+	}
+	if _, err = newSourceFilter(SourcePolicy{Deny: []string{"10.0.0.0/33"}}); err == nil {
+		t.Fatal("invalid cidr was accepted")
+	}
+}
+
+func TestSourcePolicy(t *testing.T) {
+	srvr, err := NewServer("127.0.0.1:0", StaticAuthenticator{"username": "password", "office": "password"}, WithSourcePolicy(SourcePolicy{
+		Deny: []string{"192.0.2.0/24"},
+	}, map[string]SourcePolicy{
+		"office": {Allow: []string{"10.0.0.0/8"}},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srvr.Close()
+
+	allowed, err := NewClient("tcp", srvr.Addr().String(), "username", "password", "127.0.0.1:0", WithTunnelOptions(protocol.TunnelOptions{
+		AllowSources: []string{"127.0.0.1"},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer allowed.Close()
+	public, err := net.Dial("tcp", allowed.Tunnel().Bind)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer public.Close()
+	if _, err = allowed.Accept(); err != nil {
+		t.Fatal(err)
+	}
+
+	denied, err := NewClient("tcp", srvr.Addr().String(), "username", "password", "127.0.0.1:0", WithTunnelOptions(protocol.TunnelOptions{
+		DenySources: []string{"127.0.0.0/8"},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer denied.Close()
+	public, err = net.Dial("tcp", denied.Tunnel().Bind)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer public.Close()
+	expectClosed(t, public)
+
+	// the tunnel may not allow what the policy of its key refuses
+	office, err := NewClient("tcp", srvr.Addr().String(), "office", "password", "127.0.0.1:0", WithTunnelOptions(protocol.TunnelOptions{
+		AllowSources: []string{"127.0.0.0/8"},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer office.Close()
+	public, err = net.Dial("tcp", office.Tunnel().Bind)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer public.Close()
+	expectClosed(t, public)
+
+	_, err = NewClient("tcp", srvr.Addr().String(), "username", "password", "127.0.0.1:0", WithTunnelOptions(protocol.TunnelOptions{
+		DenySources: []string{"not an address"},
+	}))
+	if !errors.Is(err, ErrBadRequest) {
+		t.Fatal("expected a bad request, got", err)
+	}
+}
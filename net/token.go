@@ -0,0 +1,98 @@
+package net
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// TokenClaims describe what a token holder may do. An empty Binds list
+// allows every address, an empty Dials list no forward tunnels.
+type TokenClaims struct {
+	Key     string    `json:"key"`
+	Binds   []string  `json:"binds,omitempty"`
+	Dials   []string  `json:"dials,omitempty"`
+	Expires time.Time `json:"exp"`
+}
+
+func _tokenSign(secret []byte, payload string) string {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// NewToken signs claims with the server token secret. The token has the form
+// payload.signature, clients only ever send the payload to the server and use
+// the signature as their shared secret.
+func NewToken(secret []byte, claims TokenClaims) (string, error) {
+	if claims.Key == "" {
+		return "", fmt.Errorf("token needs a key")
+	}
+	if claims.Expires.IsZero() {
+		return "", fmt.Errorf("token needs an expiry")
+	}
+	raw, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(raw)
+	return payload + "." + _tokenSign(secret, payload), nil
+}
+
+func splitToken(token string) (payload, signature string, err error) {
+	payload, signature, ok := strings.Cut(strings.TrimSpace(token), ".")
+	if !ok || payload == "" || signature == "" {
+		return "", "", fmt.Errorf("malformed token")
+	}
+	return payload, signature, nil
+}
+
+// TokenAuthenticator authenticates clients presenting tokens minted by
+// NewToken with the same secret.
+type TokenAuthenticator struct {
+	secret []byte
+}
+
+func (t *TokenAuthenticator) claims(payload string) (TokenClaims, string, error) {
+	var claims TokenClaims
+	raw, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return claims, "", err
+	}
+	if err = json.Unmarshal(raw, &claims); err != nil {
+		return claims, "", err
+	}
+	return claims, _tokenSign(t.secret, payload), nil
+}
+
+func (t *TokenAuthenticator) Authenticate(key, challenge, response string) (*Identity, error) {
+	claims, secret, err := t.claims(key)
+	if err != nil || !hmac.Equal([]byte(_authHashChallenge(challenge, secret)), []byte(response)) {
+		return nil, fmt.Errorf("unauthorized")
+	}
+	if !time.Now().Before(claims.Expires) {
+		return nil, fmt.Errorf("token expired")
+	}
+	return &Identity{
+		Key:     claims.Key,
+		Binds:   claims.Binds,
+		Dials:   claims.Dials,
+		Expires: claims.Expires,
+	}, nil
+}
+
+func (t *TokenAuthenticator) Prove(key, message string) (string, error) {
+	_, secret, err := t.claims(key)
+	if err != nil {
+		return "", err
+	}
+	return _authHashChallenge(message, secret), nil
+}
+
+func NewTokenAuthenticator(secret []byte) *TokenAuthenticator {
+	return &TokenAuthenticator{secret: secret}
+}
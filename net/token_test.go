@@ -0,0 +1,98 @@
+package net
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTokenAuth(t *testing.T) {
+	secret := []byte("token-secret")
+	opts := &serverOptions{tokens: NewTokenAuthenticator(secret)}
+	token, err := NewToken(secret, TokenClaims{
+		Key:     "ci",
+		Binds:   []string{":5000"},
+		Expires: time.Now().Add(time.Minute),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handshake := func(token, port string) (*Identity, error, error) {
+		server, client := net.Pipe()
+		defer server.Close()
+		defer client.Close()
+		type result struct {
+			identity *Identity
+			err      error
+		}
+		results := make(chan result, 1)
+		go func() {
+			_, identity, err := testServerAuth(server, nil, opts)
+			results <- result{identity, err}
+		}()
+		_, _, clientErr := clientSideAuth(client, "", "", port, &clientOptions{token: token})
+		res := <-results
+		return res.identity, res.err, clientErr
+	}
+	identity, serverErr, clientErr := handshake(token, ":5000")
+	if serverErr != nil || clientErr != nil {
+		t.Fatal(serverErr, clientErr)
+	}
+	if identity.Key != "ci" || identity.Expires.IsZero() {
+		t.Fatal("token claims were not applied")
+	}
+	if _, serverErr, _ = handshake(token, ":6000"); serverErr == nil {
+		t.Fatal("token bound an address it does not allow")
+	}
+	forged, err := NewToken([]byte("other-secret"), TokenClaims{
+		Key:     "ci",
+		Expires: time.Now().Add(time.Minute),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, serverErr, _ = handshake(forged, ":5000"); serverErr == nil {
+		t.Fatal("token signed with another secret was accepted")
+	}
+	expired, err := NewToken(secret, TokenClaims{
+		Key:     "ci",
+		Expires: time.Now().Add(-time.Minute),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, serverErr, _ = handshake(expired, ":5000"); serverErr == nil {
+		t.Fatal("expired token was accepted")
+	}
+}
+
+func TestTokenFailuresCountAgainstClaimedKey(t *testing.T) {
+	opts := &serverOptions{
+		tokens: NewTokenAuthenticator([]byte("token-secret")),
+		limiter: newAuthLimiter(AuthLimits{
+			BaseDelay: time.Hour,
+			MaxDelay:  time.Hour,
+			BanAfter:  10,
+			BanFor:    time.Hour,
+		}),
+	}
+	forged, err := NewToken([]byte("other-secret"), TokenClaims{
+		Key:     "ci",
+		Expires: time.Now().Add(time.Minute),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	go func() {
+		_, _, _ = clientSideAuth(client, "", "", ":5000", &clientOptions{token: forged})
+	}()
+	if _, _, err = testServerAuth(server, nil, opts); err == nil {
+		t.Fatal("token signed with another secret was accepted")
+	}
+	if opts.limiter.checkKey("ci") == nil {
+		t.Fatal("failed token did not delay its claimed key")
+	}
+}
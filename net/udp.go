@@ -0,0 +1,332 @@
+package net
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/zbrumen/remote-serve/protocol"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	maxDatagramSize    = 65535
+	defaultUDPIdle     = time.Minute
+	datagramQueueSize  = 64
+	packetConnBacklog  = 256
+	datagramHeaderSize = 2
+)
+
+// writeDatagram frames b with its length so datagrams keep their boundaries
+// on a stream.
+func writeDatagram(w io.Writer, b []byte) error {
+	if len(b) > maxDatagramSize {
+		return fmt.Errorf("datagram exceeds %d bytes", maxDatagramSize)
+	}
+	frame := make([]byte, datagramHeaderSize+len(b))
+	binary.BigEndian.PutUint16(frame, uint16(len(b)))
+	copy(frame[datagramHeaderSize:], b)
+	_, err := w.Write(frame)
+	return err
+}
+
+func readDatagram(r io.Reader, cache []byte) ([]byte, error) {
+	if _, err := io.ReadFull(r, cache[:datagramHeaderSize]); err != nil {
+		return nil, err
+	}
+	size := int(binary.BigEndian.Uint16(cache))
+	if _, err := io.ReadFull(r, cache[:size]); err != nil {
+		return nil, err
+	}
+	return cache[:size], nil
+}
+
+// udpSession carries the datagrams of one public source address.
+type udpSession struct {
+	addr   net.Addr
+	stream *protocol.Stream
+	queue  chan []byte
+	timer  *time.Timer
+	done   chan struct{}
+	once   sync.Once
+}
+
+func (s *serverConn) udpIdle() time.Duration {
+	if s.options.IdleTimeout > 0 {
+		return time.Duration(s.options.IdleTimeout)
+	}
+	return defaultUDPIdle
+}
+
+func (s *serverConn) packetBackend() {
+	cache := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := s.packets.ReadFrom(cache)
+		if err != nil {
+			_ = s.Close()
+			return
+		}
+		if s.bannedSource(addr) || !s.allowSource(addr) {
+			continue
+		}
+		session := s.udpSession(addr)
+		if session == nil {
+			continue
+		}
+		session.timer.Reset(s.udpIdle())
+		datagram := append([]byte(nil), cache[:n]...)
+		select {
+		case session.queue <- datagram:
+		default:
+			// like the network would, drop datagrams the client does not keep up with
+		}
+	}
+}
+
+func (s *serverConn) udpSession(addr net.Addr) *udpSession {
+	s.sync.Lock()
+	if session, ok := s.udp[addr.String()]; ok {
+		s.sync.Unlock()
+		return session
+	}
+	if ip, ok := _sourceAddr(addr); ok && !s.server.bans.connect(s.bind, ip) {
+		s.sync.Unlock()
+		return nil
+	}
+	if !s._reserveStream() {
+		s.sync.Unlock()
+		fmt.Println("remote-serve: " + s.name + " REACHED MAX STREAMS")
+		return nil
+	}
+	// opening the stream writes to the client, a slow one must not hold the
+	// lock of the tunnel
+	s.sync.Unlock()
+	header, err := json.Marshal(protocol.StreamHeader{
+		Type:   "udp",
+		Local:  protocol.NewAddr(s.packets.LocalAddr()).Encode(),
+		Remote: protocol.NewAddr(addr).Encode(),
+	})
+	if err != nil {
+		s.releaseStream()
+		return nil
+	}
+	stream, err := s.session.OpenStream(s.background, header)
+	if err != nil {
+		s.releaseStream()
+		fmt.Println("remote-serve: NO CLIENT CONNECTED FOR NEW DATAGRAM")
+		return nil
+	}
+	s.sync.Lock()
+	defer s.sync.Unlock()
+	if session, ok := s.udp[addr.String()]; ok {
+		s.streams--
+		_ = stream.Close()
+		return session
+	}
+	session := &udpSession{
+		addr:   addr,
+		stream: stream,
+		queue:  make(chan []byte, datagramQueueSize),
+		done:   make(chan struct{}),
+	}
+	session.timer = time.AfterFunc(s.udpIdle(), func() {
+		s.closeUDPSession(session)
+	})
+	s.udp[addr.String()] = session
+	go s.udpToClient(session)
+	go s.udpFromClient(session)
+	return session
+}
+
+func (s *serverConn) closeUDPSession(session *udpSession) {
+	session.once.Do(func() {
+		s.sync.Lock()
+		if s.udp[session.addr.String()] == session {
+			delete(s.udp, session.addr.String())
+		}
+		s.sync.Unlock()
+		close(session.done)
+		session.timer.Stop()
+		_ = session.stream.Close()
+		s.releaseStream()
+	})
+}
+
+func (s *serverConn) udpToClient(session *udpSession) {
+	defer s.closeUDPSession(session)
+	for {
+		select {
+		case datagram := <-session.queue:
+			if !s.throttle(true, len(datagram)) || writeDatagram(session.stream, datagram) != nil {
+				return
+			}
+		case <-session.done:
+			return
+		}
+	}
+}
+
+func (s *serverConn) udpFromClient(session *udpSession) {
+	defer s.closeUDPSession(session)
+	cache := make([]byte, maxDatagramSize)
+	for {
+		datagram, err := readDatagram(session.stream, cache)
+		if err != nil {
+			return
+		}
+		session.timer.Reset(s.udpIdle())
+		if !s.throttle(false, len(datagram)) {
+			return
+		}
+		if _, err = s.packets.WriteTo(datagram, session.addr); err != nil {
+			return
+		}
+	}
+}
+
+type packet struct {
+	data []byte
+	addr net.Addr
+}
+
+// packetConn is the client end of a UDP tunnel, it reads the datagrams of
+// every public source and can only answer sources it has heard from.
+type packetConn struct {
+	local net.Addr
+
+	packets chan packet
+	streams map[string]*protocol.Stream
+	writers map[string]*sync.Mutex
+	sync    sync.Mutex
+
+	deadline time.Time
+	update   chan struct{}
+
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newPacketConn(local net.Addr) *packetConn {
+	return &packetConn{
+		local:   local,
+		packets: make(chan packet, packetConnBacklog),
+		streams: make(map[string]*protocol.Stream),
+		writers: make(map[string]*sync.Mutex),
+		update:  make(chan struct{}, 1),
+		closed:  make(chan struct{}),
+	}
+}
+
+func (p *packetConn) serve(stream *protocol.Stream, remote net.Addr) {
+	key := remote.String()
+	p.sync.Lock()
+	p.streams[key] = stream
+	p.writers[key] = &sync.Mutex{}
+	p.sync.Unlock()
+	defer func() {
+		p.sync.Lock()
+		if p.streams[key] == stream {
+			delete(p.streams, key)
+			delete(p.writers, key)
+		}
+		p.sync.Unlock()
+		_ = stream.Close()
+	}()
+	cache := make([]byte, maxDatagramSize)
+	for {
+		datagram, err := readDatagram(stream, cache)
+		if err != nil {
+			return
+		}
+		select {
+		case p.packets <- packet{data: append([]byte(nil), datagram...), addr: remote}:
+		case <-p.closed:
+			return
+		default:
+		}
+	}
+}
+
+func (p *packetConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		p.sync.Lock()
+		deadline := p.deadline
+		p.sync.Unlock()
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return 0, nil, os.ErrDeadlineExceeded
+		}
+		var timeout <-chan time.Time
+		var timer *time.Timer
+		if !deadline.IsZero() {
+			timer = time.NewTimer(time.Until(deadline))
+			timeout = timer.C
+		}
+		select {
+		case pkt := <-p.packets:
+			if timer != nil {
+				timer.Stop()
+			}
+			return copy(b, pkt.data), pkt.addr, nil
+		case <-p.closed:
+			return 0, nil, net.ErrClosed
+		case <-timeout:
+		case <-p.update:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+func (p *packetConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	p.sync.Lock()
+	stream, writer := p.streams[addr.String()], p.writers[addr.String()]
+	p.sync.Unlock()
+	if stream == nil {
+		return 0, fmt.Errorf("no datagrams were received from %s", addr)
+	}
+	writer.Lock()
+	defer writer.Unlock()
+	if err := writeDatagram(stream, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (p *packetConn) Close() error {
+	p.once.Do(func() {
+		close(p.closed)
+		p.sync.Lock()
+		for _, stream := range p.streams {
+			_ = stream.Close()
+		}
+		p.sync.Unlock()
+	})
+	return nil
+}
+
+func (p *packetConn) LocalAddr() net.Addr {
+	return p.local
+}
+
+func (p *packetConn) SetDeadline(t time.Time) error {
+	return p.SetReadDeadline(t)
+}
+
+func (p *packetConn) SetReadDeadline(t time.Time) error {
+	p.sync.Lock()
+	p.deadline = t
+	p.sync.Unlock()
+	select {
+	case p.update <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (p *packetConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
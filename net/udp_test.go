@@ -0,0 +1,71 @@
+package net
+
+import (
+	"github.com/zbrumen/remote-serve/protocol"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUDPTunnel(t *testing.T) {
+	srvr, err := NewServer("127.0.0.1:0", StaticAuthenticator{"username": "password"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srvr.Close()
+	client, err := NewClient("tcp", srvr.Addr().String(), "username", "password", "127.0.0.1:0", WithTunnelOptions(protocol.TunnelOptions{
+		Protocol:    "udp",
+		IdleTimeout: protocol.Duration(time.Millisecond * 200),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	packets, err := client.PacketConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		cache := make([]byte, maxDatagramSize)
+		for {
+			n, addr, err := packets.ReadFrom(cache)
+			if err != nil {
+				return
+			}
+			_, _ = packets.WriteTo(append([]byte("echo "), cache[:n]...), addr)
+		}
+	}()
+	for _, msg := range []string{"first", "second"} {
+		public, err := net.Dial("udp", client.Tunnel().Bind)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = public.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		_ = public.SetReadDeadline(time.Now().Add(time.Second * 5))
+		cache := make([]byte, 64)
+		n, err := public.Read(cache)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(cache[:n]) != "echo "+msg {
+			t.Fatal("unexpected datagram " + string(cache[:n]))
+		}
+		_ = public.Close()
+	}
+	for start := time.Now(); client.session.NumStreams() > 0; time.Sleep(time.Millisecond * 20) {
+		if time.Since(start) > time.Second*5 {
+			t.Fatal("idle udp sessions did not expire")
+		}
+	}
+
+	tcp, err := NewClient("tcp", srvr.Addr().String(), "username", "password", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	if _, err = tcp.PacketConn(); err == nil {
+		t.Fatal("tcp tunnel returned a packet conn")
+	}
+}
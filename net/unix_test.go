@@ -0,0 +1,90 @@
+package net
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUnixSockets(t *testing.T) {
+	dir := t.TempDir()
+	local := echoServerOn(t, "unix", filepath.Join(dir, "local.sock"))
+	srvr, err := NewServer("unix:"+filepath.Join(dir, "control.sock"), StaticAuthenticator{"username": "password"}, WithUnixBindDir(filepath.Join(dir, "public")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srvr.Close()
+	if _, err = NewClient("unix", srvr.Addr().String(), "username", "password", "unix:"+filepath.Join(dir, "outside.sock")); !errors.Is(err, ErrForbiddenAddress) {
+		t.Fatal("unix bind outside of the bind directory was granted", err)
+	}
+	public := filepath.Join(dir, "public", "docker.sock")
+	if err = os.Mkdir(filepath.Dir(public), 0700); err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewClient("unix", srvr.Addr().String(), "username", "password", "unix:"+public, WithClientDialAllowlist("unix:"+local.Addr().String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if client.Tunnel().Bind != "unix:"+public {
+		t.Fatal("unexpected bind " + client.Tunnel().Bind)
+	}
+	go func() {
+		_ = client.Forward("unix", local.Addr().String())
+	}()
+	conn, err := net.Dial("unix", public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEcho(t, conn)
+	_ = conn.Close()
+
+	if conn, err = srvr.DialTunnel(context.Background(), "username", "unix:"+local.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	expectEcho(t, conn)
+	_ = conn.Close()
+	if _, err = srvr.DialTunnel(context.Background(), "username", "unix:"+filepath.Join(dir, "control.sock")); !errors.Is(err, ErrForbiddenAddress) {
+		t.Fatal("client dialed a unix socket outside of its allowlist", err)
+	}
+}
+
+func TestUnixDialPeer(t *testing.T) {
+	local := echoServerOn(t, "unix", filepath.Join(t.TempDir(), "local.sock"))
+	target := "unix:" + local.Addr().String()
+	srvr, err := NewServer("127.0.0.1:0", StaticAuthenticator{"agent-a": "a", "agent-b": "b", "agent-c": "c"}, WithPeerACL(map[string]map[string][]string{
+		"agent-a": {"agent-b": {target}},
+		"agent-c": {"*": {"*"}},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srvr.Close()
+	b, err := NewClient("tcp", srvr.Addr().String(), "agent-b", "b", "127.0.0.1:0", WithClientDialAllowlist(target))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	a, err := NewClient("tcp", srvr.Addr().String(), "agent-a", "a", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	c, err := NewClient("tcp", srvr.Addr().String(), "agent-c", "c", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	conn, err := a.DialPeer("agent-b", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEcho(t, conn)
+	_ = conn.Close()
+	if _, err = c.DialPeer("agent-b", target); !errors.Is(err, ErrForbiddenAddress) {
+		t.Fatal("wildcard peer ACL relayed to a unix socket", err)
+	}
+}
@@ -0,0 +1,101 @@
+package net
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// wsConn carries a byte stream in binary WebSocket messages.
+type wsConn struct {
+	*websocket.Conn
+
+	reader   io.Reader
+	readSync sync.Mutex
+
+	writeSync sync.Mutex
+}
+
+func (c *wsConn) Read(b []byte) (int, error) {
+	c.readSync.Lock()
+	defer c.readSync.Unlock()
+	for {
+		if c.reader == nil {
+			typ, reader, err := c.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			if typ != websocket.BinaryMessage {
+				continue
+			}
+			c.reader = reader
+		}
+		n, err := c.reader.Read(b)
+		if err == io.EOF {
+			c.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *wsConn) Write(b []byte) (int, error) {
+	c.writeSync.Lock()
+	defer c.writeSync.Unlock()
+	if err := c.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+// WebSocketDialer dials the server through a ws:// or wss:// URL, use it
+// with WithDialer.
+func WebSocketDialer(url string, tlsConfig *tls.Config) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := websocket.Dialer{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: tlsConfig,
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, resp, err := dialer.DialContext(ctx, url, nil)
+		if err != nil {
+			if resp != nil {
+				return nil, fmt.Errorf("websocket dial: %s: %w", resp.Status, err)
+			}
+			return nil, err
+		}
+		return &wsConn{Conn: conn}, nil
+	}
+}
+
+// WebSocketHandler accepts clients that connect with WebSocketDialer. The
+// connections go through the same handshake as the ones on the control port.
+func (s *Server) WebSocketHandler() http.Handler {
+	upgrader := websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool {
+			return true
+		},
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(rw, r, nil)
+		if err != nil {
+			return
+		}
+		s.accept(&wsConn{Conn: conn})
+	})
+}
@@ -0,0 +1,90 @@
+package protocol
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+type streamBuffer struct {
+	buffer   bytes.Buffer
+	closed   bool
+	err      error
+	deadline time.Time
+	timer    *time.Timer
+
+	sync sync.Mutex
+	cond *sync.Cond
+}
+
+func (b *streamBuffer) Read(p []byte) (int, error) {
+	b.sync.Lock()
+	defer b.sync.Unlock()
+	for b.buffer.Len() == 0 {
+		if b.closed {
+			return 0, b.err
+		}
+		if !b.deadline.IsZero() && !time.Now().Before(b.deadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		b.cond.Wait()
+	}
+	return b.buffer.Read(p)
+}
+
+func (b *streamBuffer) Write(p []byte) (int, error) {
+	b.sync.Lock()
+	defer b.sync.Unlock()
+	if b.closed {
+		return 0, io.ErrClosedPipe
+	}
+	n, err := b.buffer.Write(p)
+	b.cond.Broadcast()
+	return n, err
+}
+
+func (b *streamBuffer) SetDeadline(t time.Time) {
+	b.sync.Lock()
+	defer b.sync.Unlock()
+	b.deadline = t
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	if !t.IsZero() {
+		b.timer = time.AfterFunc(time.Until(t), func() {
+			b.sync.Lock()
+			b.cond.Broadcast()
+			b.sync.Unlock()
+		})
+	}
+	b.cond.Broadcast()
+}
+
+func (b *streamBuffer) Close() error {
+	return b.CloseWithError(io.EOF)
+}
+
+// CloseWithError makes Read return err once the buffered data is consumed.
+func (b *streamBuffer) CloseWithError(err error) error {
+	b.sync.Lock()
+	defer b.sync.Unlock()
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	b.err = err
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	b.cond.Broadcast()
+	return nil
+}
+
+func newStreamBuffer() *streamBuffer {
+	out := &streamBuffer{}
+	out.cond = sync.NewCond(&out.sync)
+	return out
+}
@@ -5,10 +5,13 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"net"
 	"sync"
 )
 
+const DefaultMaxFrameSize = 1 << 20
+
 type Sender interface {
 	Send(ctx context.Context, msg Message) error
 	Close() error
@@ -48,7 +51,8 @@ func NewSender(conn net.Conn) Sender {
 }
 
 type receiver struct {
-	conn net.Conn
+	conn         net.Conn
+	maxFrameSize int
 
 	recv chan Message
 }
@@ -61,10 +65,25 @@ func (c *receiver) Close() error {
 	return c.conn.Close()
 }
 
+func (c *receiver) readFrame(buffer *bufio.Reader) (string, error) {
+	var frame []byte
+	for {
+		line, err := buffer.ReadSlice('\n')
+		if len(frame)+len(line) > c.maxFrameSize {
+			return "", fmt.Errorf("frame exceeds %d bytes", c.maxFrameSize)
+		}
+		frame = append(frame, line...)
+		if err != bufio.ErrBufferFull {
+			return string(frame), err
+		}
+	}
+}
+
 func (c *receiver) backend() {
+	defer close(c.recv)
 	buffer := bufio.NewReader(c.conn)
 	for {
-		b64, err := buffer.ReadString('\n')
+		b64, err := c.readFrame(buffer)
 		if err != nil {
 			_ = c.Close()
 			return
@@ -85,8 +104,18 @@ func (c *receiver) backend() {
 }
 
 func NewReceiver(c net.Conn) Receiver {
+	return NewLimitedReceiver(c, DefaultMaxFrameSize)
+}
+
+// NewLimitedReceiver closes the connection as soon as a single frame grows
+// past maxFrameSize encoded bytes.
+func NewLimitedReceiver(c net.Conn, maxFrameSize int) Receiver {
+	if maxFrameSize <= 0 {
+		maxFrameSize = DefaultMaxFrameSize
+	}
 	out := &receiver{
-		conn: c,
+		conn:         c,
+		maxFrameSize: maxFrameSize,
 
 		recv: make(chan Message, 1),
 	}
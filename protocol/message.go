@@ -12,6 +12,7 @@ type MessageData struct {
 	Data     []byte    `json:"data"`
 	Deadline time.Time `json:"deadline"`
 	Close    bool      `json:"close"`
+	Window   int       `json:"window,omitempty"`
 }
 
 type Message struct {
@@ -0,0 +1,117 @@
+package protocol
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+const maxRecordSize = 64 * 1024
+
+type secureConn struct {
+	net.Conn
+
+	reader     cipher.AEAD
+	readNonce  uint64
+	readBuffer []byte
+	readSync   sync.Mutex
+
+	writer     cipher.AEAD
+	writeNonce uint64
+	writeSync  sync.Mutex
+}
+
+func _secureNonce(aead cipher.AEAD, counter uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], counter)
+	return nonce
+}
+
+func (c *secureConn) Read(b []byte) (int, error) {
+	c.readSync.Lock()
+	defer c.readSync.Unlock()
+	if len(c.readBuffer) == 0 {
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(c.Conn, header); err != nil {
+			return 0, err
+		}
+		size := binary.BigEndian.Uint32(header)
+		if size > maxRecordSize+uint32(c.reader.Overhead()) {
+			return 0, fmt.Errorf("encrypted record exceeds %d bytes", maxRecordSize)
+		}
+		record := make([]byte, size)
+		if _, err := io.ReadFull(c.Conn, record); err != nil {
+			return 0, err
+		}
+		plain, err := c.reader.Open(record[:0], _secureNonce(c.reader, c.readNonce), record, nil)
+		if err != nil {
+			return 0, err
+		}
+		c.readNonce++
+		c.readBuffer = plain
+	}
+	n := copy(b, c.readBuffer)
+	c.readBuffer = c.readBuffer[n:]
+	return n, nil
+}
+
+func (c *secureConn) Write(b []byte) (int, error) {
+	c.writeSync.Lock()
+	defer c.writeSync.Unlock()
+	written := 0
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > maxRecordSize {
+			chunk = chunk[:maxRecordSize]
+		}
+		record := make([]byte, 4, 4+len(chunk)+c.writer.Overhead())
+		record = c.writer.Seal(record, _secureNonce(c.writer, c.writeNonce), chunk, nil)
+		binary.BigEndian.PutUint32(record, uint32(len(record)-4))
+		if _, err := c.Conn.Write(record); err != nil {
+			return written, err
+		}
+		c.writeNonce++
+		written += len(chunk)
+		b = b[len(chunk):]
+	}
+	return written, nil
+}
+
+func _secureCipher(key []byte, direction string) (cipher.AEAD, error) {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(direction))
+	block, err := aes.NewCipher(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// NewSecureConn encrypts and authenticates everything written to conn with
+// AES-GCM. Both ends derive a key per direction from the shared session key,
+// client tells which side of the connection this end is.
+func NewSecureConn(conn net.Conn, key []byte, client bool) (net.Conn, error) {
+	toServer, err := _secureCipher(key, "client->server")
+	if err != nil {
+		return nil, err
+	}
+	toClient, err := _secureCipher(key, "server->client")
+	if err != nil {
+		return nil, err
+	}
+	out := &secureConn{
+		Conn:   conn,
+		reader: toServer,
+		writer: toClient,
+	}
+	if client {
+		out.reader, out.writer = toClient, toServer
+	}
+	return out, nil
+}
@@ -0,0 +1,64 @@
+package protocol
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestSecureConn(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	key := bytes.Repeat([]byte{7}, 32)
+	secureServer, err := NewSecureConn(server, key, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secureClient, err := NewSecureConn(client, key, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := bytes.Repeat([]byte("remote-serve"), maxRecordSize/4)
+	go func() {
+		_, _ = secureClient.Write(payload)
+	}()
+	out := make([]byte, len(payload))
+	if _, err = io.ReadFull(secureServer, out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, payload) {
+		t.Fatal("payload does not match")
+	}
+}
+
+func TestSecureConnRejectsTampering(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	key := bytes.Repeat([]byte{7}, 32)
+	secureServer, err := NewSecureConn(server, key, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plainClient, err := NewSecureConn(&tamperConn{Conn: client}, key, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_, _ = plainClient.Write([]byte("secret"))
+	}()
+	if _, err = secureServer.Read(make([]byte, 16)); err == nil {
+		t.Fatal("tampered record was accepted")
+	}
+}
+
+type tamperConn struct {
+	net.Conn
+}
+
+func (t *tamperConn) Write(b []byte) (int, error) {
+	b[len(b)-1] ^= 1
+	return t.Conn.Write(b)
+}
@@ -0,0 +1,569 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultStreamWindow  = 256 * 1024
+	DefaultAcceptBacklog = 64
+
+	maxStreamWrite = 32 * 1024
+)
+
+var (
+	ErrSessionClosed = errors.New("session closed")
+	ErrGoAway        = errors.New("session is going away")
+	ErrStreamClosed  = errors.New("stream closed by peer")
+	ErrStreamReset   = errors.New("stream reset by peer")
+)
+
+type sessionOptions struct {
+	maxFrameSize  int
+	window        int
+	acceptBacklog int
+}
+
+type SessionOption func(*sessionOptions)
+
+// WithSessionMaxFrameSize closes the session as soon as a single received
+// frame grows past size encoded bytes.
+func WithSessionMaxFrameSize(size int) SessionOption {
+	return func(o *sessionOptions) {
+		o.maxFrameSize = size
+	}
+}
+
+// WithStreamWindow is how many bytes the peer may send on a stream before
+// they have been read, it is never less than DefaultStreamWindow which both
+// ends start every stream with.
+func WithStreamWindow(size int) SessionOption {
+	return func(o *sessionOptions) {
+		o.window = size
+	}
+}
+
+// WithAcceptBacklog is how many opened streams may wait for AcceptStream,
+// the peer's streams past it are refused.
+func WithAcceptBacklog(n int) SessionOption {
+	return func(o *sessionOptions) {
+		o.acceptBacklog = n
+	}
+}
+
+// Session multiplexes streams over a single connection, both ends may open
+// and accept streams. The client and server end of a connection must pass
+// different client values so their stream ids never collide.
+type Session struct {
+	conn     net.Conn
+	sender   Sender
+	receiver Receiver
+	options  sessionOptions
+
+	streams map[string]*Stream
+	nextId  uint64
+	sync    sync.Mutex
+
+	accept chan *Stream
+
+	localGoAway  bool
+	remoteGoAway bool
+	goAwayReason string
+
+	done chan struct{}
+	once sync.Once
+}
+
+func NewSession(conn net.Conn, client bool, opts ...SessionOption) *Session {
+	options := sessionOptions{
+		maxFrameSize:  DefaultMaxFrameSize,
+		window:        DefaultStreamWindow,
+		acceptBacklog: DefaultAcceptBacklog,
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if options.window < DefaultStreamWindow {
+		options.window = DefaultStreamWindow
+	}
+	if options.acceptBacklog <= 0 {
+		options.acceptBacklog = DefaultAcceptBacklog
+	}
+	out := &Session{
+		conn:     conn,
+		sender:   NewSender(conn),
+		receiver: NewLimitedReceiver(conn, options.maxFrameSize),
+		options:  options,
+		streams:  make(map[string]*Stream),
+		nextId:   2,
+		sync:     sync.Mutex{},
+		accept:   make(chan *Stream, options.acceptBacklog),
+		done:     make(chan struct{}),
+	}
+	if client {
+		out.nextId = 1
+	}
+	go out.backend()
+	return out
+}
+
+func (s *Session) send(typ string, data MessageData) error {
+	select {
+	case <-s.done:
+		return ErrSessionClosed
+	default:
+	}
+	return s.sender.Send(context.Background(), NewMessage(typ, data))
+}
+
+func (s *Session) backend() {
+	defer s.Close()
+	for msg := range s.receiver.Receive() {
+		switch msg.Type {
+		case "open":
+			s.open(msg.Data)
+		case "go_away":
+			s.sync.Lock()
+			s.remoteGoAway = true
+			s.goAwayReason = string(msg.Data.Data)
+			s.sync.Unlock()
+		default:
+			s.sync.Lock()
+			stream := s.streams[msg.Data.Id]
+			s.sync.Unlock()
+			if stream == nil {
+				continue
+			}
+			switch msg.Type {
+			case "write":
+				stream.receive(msg.Data.Data)
+			case "window":
+				stream.grant(msg.Data.Window)
+			case "close":
+				stream.remoteClose(string(msg.Data.Data))
+			}
+		}
+	}
+}
+
+// extendWindow grants the peer the part of the receive window that exceeds
+// the window every stream starts with.
+func (s *Session) extendWindow(id string) error {
+	if extra := s.options.window - DefaultStreamWindow; extra > 0 {
+		return s.send("window", MessageData{Id: id, Window: extra})
+	}
+	return nil
+}
+
+// _peerStreamId tells whether id is a stream id the peer may open, it has
+// the parity of the ids the peer hands out.
+func (s *Session) _peerStreamId(id string) bool {
+	n, err := strconv.ParseUint(id, 10, 64)
+	return err == nil && n != 0 && n%2 != s.nextId%2
+}
+
+func (s *Session) open(data MessageData) {
+	reason := ""
+	s.sync.Lock()
+	if !s._peerStreamId(data.Id) {
+		s.sync.Unlock()
+		go func() {
+			_ = s.CloseWithReason("protocol error: stream id " + data.Id + " does not belong to the peer")
+		}()
+		return
+	}
+	if _, ok := s.streams[data.Id]; ok {
+		reason = "duplicate stream id"
+	} else if s.localGoAway {
+		reason = "session is going away"
+	} else {
+		stream := newStream(s, data.Id, data.Data)
+		select {
+		case s.accept <- stream:
+			s.streams[data.Id] = stream
+		default:
+			reason = "accept backlog is full"
+		}
+	}
+	s.sync.Unlock()
+	go func() {
+		if reason != "" {
+			_ = s.send("close", MessageData{Id: data.Id, Data: []byte(reason)})
+		} else {
+			_ = s.extendWindow(data.Id)
+		}
+	}()
+}
+
+func (s *Session) remove(stream *Stream) {
+	s.sync.Lock()
+	if s.streams[stream.id] == stream {
+		delete(s.streams, stream.id)
+	}
+	s.sync.Unlock()
+}
+
+// OpenStream opens a stream the peer receives from AcceptStream together
+// with header.
+func (s *Session) OpenStream(ctx context.Context, header []byte) (*Stream, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.sync.Lock()
+	select {
+	case <-s.done:
+		s.sync.Unlock()
+		return nil, ErrSessionClosed
+	default:
+	}
+	if s.remoteGoAway {
+		reason := s.goAwayReason
+		s.sync.Unlock()
+		return nil, fmt.Errorf("%w: %s", ErrGoAway, reason)
+	}
+	stream := newStream(s, strconv.FormatUint(s.nextId, 10), header)
+	s.nextId += 2
+	s.streams[stream.id] = stream
+	s.sync.Unlock()
+	err := s.send("open", MessageData{Id: stream.id, Data: header})
+	if err == nil {
+		err = s.extendWindow(stream.id)
+	}
+	if err != nil {
+		s.remove(stream)
+		stream.terminate(err)
+		return nil, err
+	}
+	return stream, nil
+}
+
+func (s *Session) AcceptStream(ctx context.Context) (*Stream, error) {
+	select {
+	case <-s.done:
+		return nil, ErrSessionClosed
+	default:
+	}
+	select {
+	case stream := <-s.accept:
+		return stream, nil
+	case <-s.done:
+		return nil, ErrSessionClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// GoAway tells the peer to stop opening streams, streams that are already
+// open are not affected.
+func (s *Session) GoAway(reason string) error {
+	s.sync.Lock()
+	sent := s.localGoAway
+	s.localGoAway = true
+	s.sync.Unlock()
+	if sent {
+		return nil
+	}
+	return s.send("go_away", MessageData{Data: []byte(reason)})
+}
+
+// CloseWithReason tells the peer why the session ends before closing it, the
+// peer sees reason in Err.
+func (s *Session) CloseWithReason(reason string) error {
+	_ = s.GoAway(reason)
+	return s.Close()
+}
+
+// Err is nil while the session is open. Once it is closed Err wraps
+// ErrSessionClosed, together with the reason the peer gave for going away.
+func (s *Session) Err() error {
+	select {
+	case <-s.done:
+	default:
+		return nil
+	}
+	s.sync.Lock()
+	defer s.sync.Unlock()
+	if s.remoteGoAway && s.goAwayReason != "" {
+		return fmt.Errorf("%w: %s", ErrSessionClosed, s.goAwayReason)
+	}
+	return ErrSessionClosed
+}
+
+func (s *Session) NumStreams() int {
+	s.sync.Lock()
+	defer s.sync.Unlock()
+	return len(s.streams)
+}
+
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *Session) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+func (s *Session) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+func (s *Session) Close() error {
+	err := net.ErrClosed
+	s.once.Do(func() {
+		close(s.done)
+		err = s.sender.Close()
+		s.sync.Lock()
+		streams := s.streams
+		s.streams = map[string]*Stream{}
+		s.sync.Unlock()
+		for _, stream := range streams {
+			stream.terminate(ErrSessionClosed)
+		}
+	})
+	return err
+}
+
+// Stream is a net.Conn multiplexed over a Session.
+type Stream struct {
+	session *Session
+	id      string
+	header  []byte
+
+	readBuffer *streamBuffer
+	recvWindow int
+	consumed   int
+
+	sendWindow    int
+	writeDeadline time.Time
+	writeErr      error
+	update        chan struct{}
+
+	closed       bool
+	remoteClosed bool
+	sync         sync.Mutex
+	close        sync.Once
+}
+
+func newStream(session *Session, id string, header []byte) *Stream {
+	return &Stream{
+		session:    session,
+		id:         id,
+		header:     header,
+		readBuffer: newStreamBuffer(),
+		recvWindow: session.options.window,
+		sendWindow: DefaultStreamWindow,
+		update:     make(chan struct{}, 1),
+	}
+}
+
+func (st *Stream) signal() {
+	select {
+	case st.update <- struct{}{}:
+	default:
+	}
+}
+
+func (st *Stream) receive(data []byte) {
+	st.sync.Lock()
+	if len(data) > st.recvWindow {
+		st.sync.Unlock()
+		_ = st.CloseWithReason("stream window exceeded")
+		return
+	}
+	st.recvWindow -= len(data)
+	st.sync.Unlock()
+	_, _ = st.readBuffer.Write(data)
+}
+
+func (st *Stream) grant(n int) {
+	if n <= 0 {
+		return
+	}
+	st.sync.Lock()
+	st.sendWindow += n
+	st.sync.Unlock()
+	st.signal()
+}
+
+func (st *Stream) remoteClose(reason string) {
+	readErr, writeErr := io.EOF, ErrStreamClosed
+	if reason != "" {
+		readErr = fmt.Errorf("%w: %s", ErrStreamReset, reason)
+		writeErr = readErr
+	}
+	st.sync.Lock()
+	st.remoteClosed = true
+	if st.writeErr == nil {
+		st.writeErr = writeErr
+	}
+	st.sync.Unlock()
+	_ = st.readBuffer.CloseWithError(readErr)
+	st.signal()
+	st.session.remove(st)
+}
+
+func (st *Stream) terminate(err error) {
+	st.sync.Lock()
+	st.remoteClosed = true
+	if st.writeErr == nil {
+		st.writeErr = err
+	}
+	st.sync.Unlock()
+	_ = st.readBuffer.CloseWithError(err)
+	st.signal()
+}
+
+func (st *Stream) Id() string {
+	return st.id
+}
+
+// Header is what the stream was opened with.
+func (st *Stream) Header() []byte {
+	return st.header
+}
+
+func (st *Stream) Read(b []byte) (int, error) {
+	st.sync.Lock()
+	closed := st.closed
+	st.sync.Unlock()
+	if closed {
+		return 0, net.ErrClosed
+	}
+	n, err := st.readBuffer.Read(b)
+	if n > 0 {
+		st.sync.Lock()
+		st.consumed += n
+		credit := 0
+		if st.consumed >= st.session.options.window/2 && st.writeErr == nil {
+			credit = st.consumed
+			st.consumed = 0
+			st.recvWindow += credit
+		}
+		st.sync.Unlock()
+		if credit > 0 {
+			_ = st.session.send("window", MessageData{Id: st.id, Window: credit})
+		}
+	}
+	return n, err
+}
+
+func (st *Stream) reserve(size int) (int, error) {
+	for {
+		st.sync.Lock()
+		if st.writeErr != nil {
+			err := st.writeErr
+			st.sync.Unlock()
+			return 0, err
+		}
+		deadline := st.writeDeadline
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			st.sync.Unlock()
+			return 0, os.ErrDeadlineExceeded
+		}
+		if st.sendWindow > 0 {
+			chunk := size
+			if chunk > st.sendWindow {
+				chunk = st.sendWindow
+			}
+			if chunk > maxStreamWrite {
+				chunk = maxStreamWrite
+			}
+			st.sendWindow -= chunk
+			if st.sendWindow > 0 {
+				st.signal()
+			}
+			st.sync.Unlock()
+			return chunk, nil
+		}
+		st.sync.Unlock()
+		var timeout <-chan time.Time
+		var timer *time.Timer
+		if !deadline.IsZero() {
+			timer = time.NewTimer(time.Until(deadline))
+			timeout = timer.C
+		}
+		select {
+		case <-st.update:
+		case <-timeout:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// Write blocks while the peer has not read what was written before, see
+// WithStreamWindow.
+func (st *Stream) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		chunk, err := st.reserve(len(b))
+		if err != nil {
+			return n, err
+		}
+		if err = st.session.send("write", MessageData{Id: st.id, Data: b[:chunk]}); err != nil {
+			return n, err
+		}
+		n += chunk
+		b = b[chunk:]
+	}
+	return n, nil
+}
+
+func (st *Stream) Close() error {
+	return st.CloseWithReason("")
+}
+
+// CloseWithReason closes the stream, reads and writes of the peer fail with
+// ErrStreamReset and reason instead of io.EOF.
+func (st *Stream) CloseWithReason(reason string) error {
+	err := net.ErrClosed
+	st.close.Do(func() {
+		st.sync.Lock()
+		remote := st.remoteClosed
+		st.closed = true
+		st.writeErr = net.ErrClosed
+		st.sync.Unlock()
+		_ = st.readBuffer.CloseWithError(net.ErrClosed)
+		st.signal()
+		st.session.remove(st)
+		err = nil
+		if !remote {
+			err = st.session.send("close", MessageData{Id: st.id, Data: []byte(reason)})
+		}
+	})
+	return err
+}
+
+func (st *Stream) LocalAddr() net.Addr {
+	return st.session.LocalAddr()
+}
+
+func (st *Stream) RemoteAddr() net.Addr {
+	return st.session.RemoteAddr()
+}
+
+func (st *Stream) SetDeadline(t time.Time) error {
+	_ = st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.readBuffer.SetDeadline(t)
+	return nil
+}
+
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.sync.Lock()
+	st.writeDeadline = t
+	st.sync.Unlock()
+	st.signal()
+	return nil
+}
@@ -0,0 +1,188 @@
+package protocol
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func testSessions(t *testing.T, opts ...SessionOption) (*Session, *Session) {
+	t.Helper()
+	server, client := net.Pipe()
+	serverSession, clientSession := NewSession(server, false, opts...), NewSession(client, true, opts...)
+	t.Cleanup(func() {
+		_ = serverSession.Close()
+		_ = clientSession.Close()
+	})
+	return serverSession, clientSession
+}
+
+func TestSessionStreams(t *testing.T) {
+	server, client := testSessions(t)
+	for _, pair := range [][2]*Session{{server, client}, {client, server}} {
+		opener, acceptor := pair[0], pair[1]
+		stream, err := opener.OpenStream(context.Background(), []byte("header"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		accepted, err := acceptor.AcceptStream(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(accepted.Header()) != "header" {
+			t.Fatal("unexpected header " + string(accepted.Header()))
+		}
+		// more than the window, so the writer has to wait for window updates
+		payload := make([]byte, DefaultStreamWindow*3)
+		_, _ = rand.Read(payload)
+		go func() {
+			_, _ = stream.Write(payload)
+			_ = stream.Close()
+		}()
+		received, err := io.ReadAll(accepted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(received, payload) {
+			t.Fatal("payload was corrupted")
+		}
+		_ = accepted.Close()
+	}
+}
+
+func TestSessionStreamWindow(t *testing.T) {
+	server, client := testSessions(t)
+	stream, err := server.OpenStream(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.AcceptStream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = stream.Write(make([]byte, DefaultStreamWindow)); err != nil {
+		t.Fatal(err)
+	}
+	_ = stream.SetWriteDeadline(time.Now().Add(time.Millisecond * 100))
+	if _, err = stream.Write([]byte{0}); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("write past an unread window did not block", err)
+	}
+}
+
+func TestSessionCloseWithReason(t *testing.T) {
+	server, client := testSessions(t)
+	stream, err := server.OpenStream(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := client.AcceptStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = accepted.CloseWithReason("refused")
+	if _, err = stream.Read(make([]byte, 1)); !errors.Is(err, ErrStreamReset) {
+		t.Fatal("expected a reset, got", err)
+	}
+}
+
+func TestSessionGoAway(t *testing.T) {
+	server, client := testSessions(t)
+	stream, err := server.OpenStream(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := client.AcceptStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = client.GoAway("restarting"); err != nil {
+		t.Fatal(err)
+	}
+	for start := time.Now(); ; time.Sleep(time.Millisecond * 10) {
+		if _, err = server.OpenStream(context.Background(), nil); errors.Is(err, ErrGoAway) {
+			break
+		}
+		if time.Since(start) > time.Second*5 {
+			t.Fatal("server kept opening streams after go away")
+		}
+	}
+	go func() {
+		_, _ = stream.Write([]byte("still open"))
+	}()
+	cache := make([]byte, 10)
+	if _, err = io.ReadFull(accepted, cache); err != nil || string(cache) != "still open" {
+		t.Fatal("open stream broke after go away", err)
+	}
+}
+
+func TestSessionAcceptBacklog(t *testing.T) {
+	server, _ := testSessions(t, WithAcceptBacklog(1))
+	if _, err := server.OpenStream(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	refused, err := server.OpenStream(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = refused.Read(make([]byte, 1)); !errors.Is(err, ErrStreamReset) {
+		t.Fatal("stream past the backlog was not refused", err)
+	}
+}
+
+func TestSessionClose(t *testing.T) {
+	server, client := testSessions(t)
+	stream, err := server.OpenStream(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = client.Close()
+	if _, err = stream.Read(make([]byte, 1)); !errors.Is(err, ErrSessionClosed) {
+		t.Fatal("expected the session to be closed, got", err)
+	}
+	if _, err = client.AcceptStream(context.Background()); !errors.Is(err, ErrSessionClosed) {
+		t.Fatal("expected the session to be closed, got", err)
+	}
+}
+
+func TestSessionCloseWithReasonErr(t *testing.T) {
+	server, client := testSessions(t)
+	if client.Err() != nil {
+		t.Fatal("open session reported an error")
+	}
+	_ = server.CloseWithReason("quota exceeded")
+	select {
+	case <-client.Done():
+	case <-time.After(time.Second * 5):
+		t.Fatal("session did not close")
+	}
+	if err := client.Err(); !errors.Is(err, ErrSessionClosed) || err.Error() != "session closed: quota exceeded" {
+		t.Fatal("unexpected session error", err)
+	}
+}
+
+func TestSessionRejectsLocalStreamId(t *testing.T) {
+	server, client := net.Pipe()
+	session := NewSession(server, false)
+	defer session.Close()
+	defer client.Close()
+	go func() {
+		_, _ = io.Copy(io.Discard, client)
+	}()
+	// the server hands out even ids, a client must not open one
+	if err := NewSender(client).Send(context.Background(), NewMessage("open", MessageData{Id: "2"})); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-session.Done():
+	case <-time.After(time.Second * 5):
+		t.Fatal("session accepted a stream id of its own parity")
+	}
+	if _, err := session.AcceptStream(context.Background()); !errors.Is(err, ErrSessionClosed) {
+		t.Fatal("expected the session to be closed, got", err)
+	}
+}
@@ -0,0 +1,114 @@
+package protocol
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const Version = 2
+
+// Error codes the server answers refused handshakes with.
+const (
+	ErrorUnauthorized     = "unauthorized"
+	ErrorRateLimited      = "rate_limited"
+	ErrorBadRequest       = "bad_request"
+	ErrorProtocolVersion  = "protocol_version"
+	ErrorAddressInUse     = "address_in_use"
+	ErrorForbiddenAddress = "forbidden_address"
+	ErrorUnavailable      = "unavailable"
+	ErrorQuotaExceeded    = "quota_exceeded"
+)
+
+// Duration is a time.Duration that is written as "30s" in JSON.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var str string
+	if err := json.Unmarshal(b, &str); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(str)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// TunnelOptions are requested by the client and granted by the server. A
+// Mirror tunnel does not listen, it receives a copy of the incoming bytes of
+// a MirrorRate share of the streams of the tunnel the same key bound to the
+// same address and its responses are discarded. AllowSources and
+// DenySources narrow down the public sources the server allows to reach the
+// tunnel.
+type TunnelOptions struct {
+	Protocol      string            `json:"protocol,omitempty"`
+	Hostnames     []string          `json:"hostnames,omitempty"`
+	ProxyProtocol bool              `json:"proxy_protocol,omitempty"`
+	IdleTimeout   Duration          `json:"idle_timeout,omitempty"`
+	MaxStreams    int               `json:"max_streams,omitempty"`
+	Labels        map[string]string `json:"labels,omitempty"`
+	Mirror        bool              `json:"mirror,omitempty"`
+	MirrorRate    float64           `json:"mirror_rate,omitempty"`
+	AllowSources  []string          `json:"allow_sources,omitempty"`
+	DenySources   []string          `json:"deny_sources,omitempty"`
+}
+
+// TunnelRequest is the first message a client sends to the server.
+type TunnelRequest struct {
+	Version int           `json:"version"`
+	Key     string        `json:"key"`
+	Mode    string        `json:"mode"`
+	Nonce   string        `json:"nonce"`
+	Encrypt bool          `json:"encrypt,omitempty"`
+	Bind    string        `json:"bind"`
+	Options TunnelOptions `json:"options"`
+}
+
+// TunnelChallenge is the server answer to a TunnelRequest, either the
+// challenge the client has to sign or the reason the request was refused.
+type TunnelChallenge struct {
+	Version   int    `json:"version"`
+	Challenge string `json:"challenge,omitempty"`
+	Error     string `json:"error,omitempty"`
+	Message   string `json:"message,omitempty"`
+}
+
+// TunnelResponse answers an authenticated TunnelRequest. Bind is the address
+// the server listens on, it is empty and Error is set when the tunnel was
+// refused. Errors are keyed by the request field they refer to.
+type TunnelResponse struct {
+	Version int               `json:"version"`
+	Bind    string            `json:"bind,omitempty"`
+	Granted TunnelOptions     `json:"granted"`
+	Errors  map[string]string `json:"errors,omitempty"`
+	Error   string            `json:"error,omitempty"`
+	Message string            `json:"message,omitempty"`
+}
+
+// StreamHeader opens a stream of a tunnel. Streams of type "tcp" carry a
+// public connection and streams of type "udp" the length prefixed datagrams
+// of a public source, Local and Remote are their encoded addresses. Streams of
+// type "dial" ask the peer to connect to Target, or to relay the stream to
+// the client connected as Peer which then connects to Target.
+type StreamHeader struct {
+	Type    string `json:"type"`
+	Local   string `json:"local,omitempty"`
+	Remote  string `json:"remote,omitempty"`
+	Network string `json:"network,omitempty"`
+	Target  string `json:"target,omitempty"`
+	Peer    string `json:"peer,omitempty"`
+}
+
+// StreamResponse is the first line the server writes to a "dial" stream,
+// the stream is closed after it when Error is set.
+type StreamResponse struct {
+	Error   string `json:"error,omitempty"`
+	Message string `json:"message,omitempty"`
+	Local   string `json:"local,omitempty"`
+	Remote  string `json:"remote,omitempty"`
+}
@@ -0,0 +1,112 @@
+package remote_serve
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/zbrumen/remote-serve/net"
+	gonet "net"
+	"sync"
+	"time"
+)
+
+const maxReconnectInterval = time.Minute
+
+// reconnectListener dials the server again whenever the tunnel breaks.
+type reconnectListener struct {
+	dial     func(ctx context.Context) (*net.Client, error)
+	interval time.Duration
+
+	current *net.Client
+	sync    sync.Mutex
+	// redial lets a single Accept reconnect at a time, sync is not held while
+	// it waits so Addr and Close do not block on the backoff
+	redial sync.Mutex
+
+	background context.Context
+	cancel     context.CancelFunc
+}
+
+func (r *reconnectListener) client() *net.Client {
+	r.sync.Lock()
+	defer r.sync.Unlock()
+	return r.current
+}
+
+func (r *reconnectListener) reconnect(broken *net.Client) error {
+	r.redial.Lock()
+	defer r.redial.Unlock()
+	if r.client() != broken {
+		return nil
+	}
+	_ = broken.Close()
+	interval := r.interval
+	for {
+		fmt.Println("remote-serve: TUNNEL BROKEN, RECONNECTING")
+		client, err := r.dial(r.background)
+		if err == nil {
+			r.sync.Lock()
+			r.current = client
+			r.sync.Unlock()
+			// Close may have run while dialing
+			if r.background.Err() != nil {
+				_ = client.Close()
+				return gonet.ErrClosed
+			}
+			return nil
+		}
+		var tunnelErr *net.TunnelError
+		if errors.As(err, &tunnelErr) && !tunnelErr.Temporary() {
+			return err
+		}
+		fmt.Println("remote-serve: RECONNECT ERROR: " + err.Error())
+		select {
+		case <-r.background.Done():
+			return gonet.ErrClosed
+		case <-time.After(interval):
+		}
+		if interval *= 2; interval > maxReconnectInterval {
+			interval = maxReconnectInterval
+		}
+	}
+}
+
+func (r *reconnectListener) Accept() (gonet.Conn, error) {
+	for {
+		client := r.client()
+		conn, err := client.Accept()
+		if err == nil {
+			return conn, nil
+		}
+		if r.background.Err() != nil {
+			return nil, gonet.ErrClosed
+		}
+		if err = r.reconnect(client); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (r *reconnectListener) Close() error {
+	r.cancel()
+	return r.client().Close()
+}
+
+func (r *reconnectListener) Addr() gonet.Addr {
+	return r.client().Addr()
+}
+
+func newReconnectListener(ctx context.Context, interval time.Duration, dial func(ctx context.Context) (*net.Client, error)) (*reconnectListener, error) {
+	client, err := dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	background, cancel := context.WithCancel(context.Background())
+	return &reconnectListener{
+		dial:       dial,
+		interval:   interval,
+		current:    client,
+		background: background,
+		cancel:     cancel,
+	}, nil
+}
@@ -0,0 +1,152 @@
+package remote_serve
+
+import (
+	"context"
+	"errors"
+	gonet "net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const defaultShutdownTimeout = time.Second * 30
+
+type acceptResult struct {
+	conn gonet.Conn
+	err  error
+}
+
+// drainListener stops accepting on Close but keeps the underlying listener,
+// and with it every tunneled connection, open until it is closed for good.
+type drainListener struct {
+	gonet.Listener
+
+	results chan acceptResult
+	closed  chan struct{}
+	once    sync.Once
+}
+
+func (d *drainListener) backend() {
+	for {
+		conn, err := d.Listener.Accept()
+		select {
+		case d.results <- acceptResult{conn, err}:
+			if err != nil {
+				return
+			}
+		case <-d.closed:
+			if conn != nil {
+				_ = conn.Close()
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (d *drainListener) Accept() (gonet.Conn, error) {
+	select {
+	case res := <-d.results:
+		return res.conn, res.err
+	case <-d.closed:
+		return nil, gonet.ErrClosed
+	}
+}
+
+func (d *drainListener) Close() error {
+	d.once.Do(func() {
+		close(d.closed)
+	})
+	return nil
+}
+
+func newDrainListener(listener gonet.Listener) *drainListener {
+	out := &drainListener{
+		Listener: listener,
+		results:  make(chan acceptResult),
+		closed:   make(chan struct{}),
+	}
+	go out.backend()
+	return out
+}
+
+func serve(ctx context.Context, addrs []string, handler http.Handler, opts []Option, run func(srvr *http.Server, listener gonet.Listener) error) error {
+	o := options{shutdownTimeout: defaultShutdownTimeout}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	var listeners []gonet.Listener
+	closeAll := func() error {
+		var errs []error
+		for _, listener := range listeners {
+			if err := listener.Close(); err != nil && !errors.Is(err, gonet.ErrClosed) {
+				errs = append(errs, err)
+			}
+		}
+		return errors.Join(errs...)
+	}
+	for _, addr := range addrs {
+		listener, err := Listen(ctx, addr, opts...)
+		if err != nil {
+			_ = closeAll()
+			return err
+		}
+		listeners = append(listeners, listener)
+	}
+	srvr := newHTTPServer("", handler, &o)
+	errs := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		go func(drain gonet.Listener) {
+			errs <- run(srvr, drain)
+		}(newDrainListener(listener))
+	}
+	var out []error
+	running := len(listeners)
+	select {
+	case err := <-errs:
+		running--
+		out = append(out, err)
+	case <-ctx.Done():
+	}
+	shutdown, cancel := context.WithTimeout(context.Background(), o.shutdownTimeout)
+	defer cancel()
+	out = append(out, srvr.Shutdown(shutdown), closeAll())
+	for ; running > 0; running-- {
+		out = append(out, <-errs)
+	}
+	var result []error
+	for _, err := range out {
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			result = append(result, err)
+		}
+	}
+	return errors.Join(result...)
+}
+
+// Serve serves handler on the listener of the addr URL until ctx is done.
+// It then stops accepting, waits for in-flight requests to finish within the
+// shutdown timeout and only afterwards closes the listener, for remote://
+// URLs the tunnel and its control connection.
+func Serve(ctx context.Context, addr string, handler http.Handler, opts ...Option) error {
+	return ServeAll(ctx, []string{addr}, handler, opts...)
+}
+
+func ServeTLS(ctx context.Context, addr string, handler http.Handler, certFile, keyFile string, opts ...Option) error {
+	return ServeAllTLS(ctx, []string{addr}, handler, certFile, keyFile, opts...)
+}
+
+// ServeAll serves handler on every addr URL, e.g. a local address and a
+// remote:// tunnel, with one lifecycle. When one listener fails or ctx is
+// done all of them are shut down together and their errors are returned.
+func ServeAll(ctx context.Context, addrs []string, handler http.Handler, opts ...Option) error {
+	return serve(ctx, addrs, handler, opts, func(srvr *http.Server, listener gonet.Listener) error {
+		return srvr.Serve(listener)
+	})
+}
+
+func ServeAllTLS(ctx context.Context, addrs []string, handler http.Handler, certFile, keyFile string, opts ...Option) error {
+	return serve(ctx, addrs, handler, opts, func(srvr *http.Server, listener gonet.Listener) error {
+		return srvr.ServeTLS(listener, certFile, keyFile)
+	})
+}
@@ -0,0 +1,135 @@
+package remote_serve
+
+import (
+	"context"
+	"github.com/zbrumen/remote-serve/net"
+	"io"
+	gonet "net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	listener, err := gonet.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+func waitForAddr(t *testing.T, addr string) {
+	t.Helper()
+	for start := time.Now(); time.Since(start) < time.Second*5; time.Sleep(time.Millisecond * 20) {
+		if conn, err := gonet.Dial("tcp", addr); err == nil {
+			_ = conn.Close()
+			return
+		}
+	}
+	t.Fatal(addr, "never became reachable")
+}
+
+func TestServeGracefulShutdown(t *testing.T) {
+	srvr, err := net.NewServer("127.0.0.1:0", net.StaticAuthenticator{"username": "password"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srvr.Close()
+	bind := freeAddr(t)
+	started := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	served := make(chan error, 1)
+	go func() {
+		served <- Serve(ctx, "remote://username:password@"+srvr.Addr().String()+"/"+bind, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/slow" {
+				close(started)
+				time.Sleep(time.Millisecond * 300)
+			}
+			_, _ = rw.Write([]byte("done"))
+		}))
+	}()
+	waitForAddr(t, bind)
+	responses := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + bind + "/slow")
+		if err != nil {
+			responses <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		out, _ := io.ReadAll(resp.Body)
+		responses <- string(out)
+	}()
+	<-started
+	cancel()
+	if out := <-responses; out != "done" {
+		t.Fatal("in-flight request was not drained: " + out)
+	}
+	if err = <-served; err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 100)
+	if conn, err := gonet.Dial("tcp", bind); err == nil {
+		_ = conn.Close()
+		t.Fatal("tunnel is still open after shutdown")
+	}
+}
+
+func TestServeAll(t *testing.T) {
+	srvr, err := net.NewServer("127.0.0.1:0", net.StaticAuthenticator{"username": "password"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srvr.Close()
+	local, bind := freeAddr(t), freeAddr(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	served := make(chan error, 1)
+	go func() {
+		served <- ServeAll(ctx, []string{
+			"tcp://" + local,
+			"remote://username:password@" + srvr.Addr().String() + "/" + bind,
+		}, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			_, _ = rw.Write([]byte("done"))
+		}))
+	}()
+	for _, addr := range []string{local, bind} {
+		waitForAddr(t, addr)
+		resp, err := http.Get("http://" + addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if string(out) != "done" {
+			t.Fatal("unexpected response from " + addr + ": " + string(out))
+		}
+	}
+	cancel()
+	if err = <-served; err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 100)
+	for _, addr := range []string{local, bind} {
+		if conn, err := gonet.Dial("tcp", addr); err == nil {
+			_ = conn.Close()
+			t.Fatal(addr + " is still open after shutdown")
+		}
+	}
+}
+
+func TestServeAllListenError(t *testing.T) {
+	local := freeAddr(t)
+	err := ServeAll(context.Background(), []string{"tcp://" + local, "bogus://nowhere"}, http.NotFoundHandler())
+	if err == nil {
+		t.Fatal("expected an error for an unsupported scheme")
+	}
+	listener, err := gonet.Listen("tcp", local)
+	if err != nil {
+		t.Fatal("listener of a failed ServeAll was not closed: " + err.Error())
+	}
+	_ = listener.Close()
+}
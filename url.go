@@ -0,0 +1,194 @@
+package remote_serve
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"github.com/zbrumen/remote-serve/net"
+	"github.com/zbrumen/remote-serve/protocol"
+	gonet "net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultBind = ":8080"
+
+// remoteURL is a parsed remote:// URL:
+//
+//	remote[+tls|+ws|+wss]://key:secret@server:port[/bind][?option=value&...]
+//
+// The bind address is taken from the path ("/:5000", "/127.0.0.1:5000"),
+// the bind query parameter, or the legacy base64 encoded path, in that order,
+// and defaults to :8080. Supported query parameters are bind, tls, transport
+// (tcp or ws), path (WebSocket path), reconnect (true or a retry interval),
+// hostname (repeatable), timeout, idle_timeout, max_streams, proxy_protocol,
+// encrypt and token.
+type remoteURL struct {
+	server    string
+	key       string
+	secret    string
+	bind      string
+	tls       bool
+	transport string
+	wsPath    string
+	reconnect time.Duration
+	timeout   time.Duration
+	encrypt   bool
+	token     string
+	tunnel    protocol.TunnelOptions
+}
+
+func _urlBool(name, value string) (bool, error) {
+	out, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("%s: expected true or false, got %q", name, value)
+	}
+	return out, nil
+}
+
+func _urlDuration(name, value string) (time.Duration, error) {
+	out, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s: expected a duration like 30s, got %q", name, value)
+	}
+	return out, nil
+}
+
+func _urlBindFromPath(path string) (string, error) {
+	path = strings.TrimPrefix(path, "/")
+	if path == "" {
+		return "", nil
+	}
+	if _, _, err := gonet.SplitHostPort(path); err == nil {
+		return path, nil
+	}
+	if raw, err := base64.URLEncoding.DecodeString(path); err == nil {
+		if _, _, err = gonet.SplitHostPort(string(raw)); err == nil {
+			return string(raw), nil
+		}
+	}
+	return "", fmt.Errorf("cannot read a bind address from path %q, use /:port or ?bind=host:port", "/"+path)
+}
+
+func parseRemoteURL(u *url.URL) (*remoteURL, error) {
+	out := &remoteURL{
+		server:    u.Host,
+		key:       u.User.Username(),
+		transport: "tcp",
+		wsPath:    "/",
+	}
+	out.secret, _ = u.User.Password()
+	switch u.Scheme {
+	case "remote", "remote+tcp":
+	case "remote+tls":
+		out.tls = true
+	case "remote+ws":
+		out.transport = "ws"
+	case "remote+wss":
+		out.transport = "ws"
+		out.tls = true
+	default:
+		return nil, fmt.Errorf("unsupported scheme %s", u.Scheme)
+	}
+	if out.server == "" {
+		return nil, fmt.Errorf("remote URL needs a server address")
+	}
+	bind, err := _urlBindFromPath(u.Path)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range u.Query() {
+		value := values[len(values)-1]
+		switch name {
+		case "bind":
+			if bind != "" && bind != value {
+				return nil, fmt.Errorf("bind address given in both path and query")
+			}
+			if _, _, err = gonet.SplitHostPort(value); err != nil {
+				return nil, fmt.Errorf("bind: %w", err)
+			}
+			bind = value
+		case "tls":
+			out.tls, err = _urlBool(name, value)
+		case "transport":
+			if value != "tcp" && value != "ws" {
+				return nil, fmt.Errorf("transport: expected tcp or ws, got %q", value)
+			}
+			out.transport = value
+		case "path":
+			out.wsPath = value
+		case "reconnect":
+			var on bool
+			if on, err = strconv.ParseBool(value); err == nil {
+				if on {
+					out.reconnect = time.Second
+				}
+			} else {
+				out.reconnect, err = _urlDuration(name, value)
+			}
+		case "hostname":
+			out.tunnel.Hostnames = append(out.tunnel.Hostnames, values...)
+		case "timeout":
+			out.timeout, err = _urlDuration(name, value)
+		case "idle_timeout":
+			var idle time.Duration
+			idle, err = _urlDuration(name, value)
+			out.tunnel.IdleTimeout = protocol.Duration(idle)
+		case "max_streams":
+			out.tunnel.MaxStreams, err = strconv.Atoi(value)
+		case "proxy_protocol":
+			out.tunnel.ProxyProtocol, err = _urlBool(name, value)
+		case "encrypt":
+			out.encrypt, err = _urlBool(name, value)
+		case "token":
+			out.token = value
+		default:
+			return nil, fmt.Errorf("unknown remote URL option %s", name)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if bind == "" {
+		bind = defaultBind
+	}
+	out.bind = bind
+	return out, nil
+}
+
+func (r *remoteURL) clientOptions(o *options) []net.ClientOption {
+	var out []net.ClientOption
+	var tlsConfig *tls.Config
+	if r.tls {
+		tlsConfig = o.tls
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+	}
+	switch r.transport {
+	case "ws":
+		scheme := "ws"
+		if r.tls {
+			scheme = "wss"
+		}
+		endpoint := url.URL{Scheme: scheme, Host: r.server, Path: r.wsPath}
+		out = append(out, net.WithDialer(net.WebSocketDialer(endpoint.String(), tlsConfig)))
+	default:
+		if tlsConfig != nil {
+			out = append(out, net.WithTLS(tlsConfig))
+		}
+	}
+	if r.timeout > 0 {
+		out = append(out, net.WithConnectTimeout(r.timeout))
+	}
+	if r.encrypt {
+		out = append(out, net.WithEncryption())
+	}
+	if r.token != "" {
+		out = append(out, net.WithToken(r.token))
+	}
+	out = append(out, net.WithTunnelOptions(r.tunnel))
+	return append(out, o.client...)
+}
@@ -0,0 +1,142 @@
+package remote_serve
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/zbrumen/remote-serve/net"
+	gonet "net"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRemoteURL(t *testing.T) {
+	for raw, bind := range map[string]string{
+		"remote://u:p@localhost:4000":                        ":8080",
+		"remote://u:p@localhost:4000/":                       ":8080",
+		"remote://u:p@localhost:4000/:5000":                  ":5000",
+		"remote://u:p@localhost:4000/127.0.0.1:5000":         "127.0.0.1:5000",
+		"remote://u:p@localhost:4000/?bind=:5000":            ":5000",
+		"remote://u:p@localhost:4000/OjUwMDA=":               ":5000",
+		"remote+tls://u:p@localhost:4000/:5000?timeout=3s":   ":5000",
+		"remote+wss://u:p@localhost:4000/:5000?path=/tunnel": ":5000",
+	} {
+		u, err := url.Parse(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		remote, err := parseRemoteURL(u)
+		if err != nil {
+			t.Fatal(raw, err)
+		}
+		if remote.bind != bind {
+			t.Fatal(raw, "bound", remote.bind, "instead of", bind)
+		}
+	}
+	for _, raw := range []string{
+		"remote://u:p@localhost:4000/not-an-address",
+		"remote://u:p@localhost:4000/:5000?bind=:6000",
+		"remote://u:p@localhost:4000/:5000?transport=quic",
+		"remote://u:p@localhost:4000/:5000?tls=maybe",
+		"remote://u:p@localhost:4000/:5000?unknown=1",
+	} {
+		u, err := url.Parse(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = parseRemoteURL(u); err == nil {
+			t.Fatal(raw, "was accepted")
+		}
+	}
+	u, _ := url.Parse("remote+wss://u:p@localhost:4000/:5000?reconnect=true&hostname=a.example&hostname=b.example&proxy_protocol=1")
+	remote, err := parseRemoteURL(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !remote.tls || remote.transport != "ws" || remote.reconnect == 0 || len(remote.tunnel.Hostnames) != 2 || !remote.tunnel.ProxyProtocol {
+		t.Fatalf("options were not applied %+v", remote)
+	}
+}
+
+func TestListenWebSocket(t *testing.T) {
+	srvr, err := net.NewServer("127.0.0.1:0", net.StaticAuthenticator{"username": "password"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srvr.Close()
+	ws := httptest.NewTLSServer(srvr.WebSocketHandler())
+	defer ws.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(ws.Certificate())
+	listener, err := Listen(context.Background(), "remote+wss://username:password@"+strings.TrimPrefix(ws.URL, "https://")+"/127.0.0.1:0", WithTLSConfig(&tls.Config{RootCAs: pool}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bind := listener.(*net.Client).Tunnel().Bind
+	testListener(t, listener, func() (gonet.Conn, error) {
+		return gonet.Dial("tcp", bind)
+	})
+}
+
+func TestListenReconnect(t *testing.T) {
+	srvr, err := net.NewServer("127.0.0.1:0", net.StaticAuthenticator{"username": "password"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := srvr.Addr().String()
+	free, err := gonet.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bind := free.Addr().String()
+	_ = free.Close()
+	listener, err := Listen(context.Background(), "remote://username:password@"+addr+"/"+bind+"?reconnect=50ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = srvr.Close()
+	srvr, err = net.NewServer(addr, net.StaticAuthenticator{"username": "password"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srvr.Close()
+	testListener(t, listener, func() (gonet.Conn, error) {
+		for start := time.Now(); time.Since(start) < time.Second*5; time.Sleep(time.Millisecond * 50) {
+			if conn, err := gonet.Dial("tcp", bind); err == nil {
+				return conn, nil
+			}
+		}
+		return gonet.Dial("tcp", bind)
+	})
+}
+
+func TestReconnectBackoffDoesNotBlockAddr(t *testing.T) {
+	srvr, err := net.NewServer("127.0.0.1:0", net.StaticAuthenticator{"username": "password"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := Listen(context.Background(), "remote://username:password@"+srvr.Addr().String()+"/127.0.0.1:0?reconnect=1h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = srvr.Close()
+	go func() {
+		_, _ = listener.Accept()
+	}()
+	// let Accept find the tunnel broken and wait for the next attempt
+	time.Sleep(time.Millisecond * 200)
+	done := make(chan struct{})
+	go func() {
+		_ = listener.Addr()
+		_ = listener.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("Addr blocked on the reconnect backoff")
+	}
+}